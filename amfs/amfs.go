@@ -1,102 +1,226 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/ConradIrwin/amfs/cfg"
 	"github.com/automerge/automerge-go"
 	"github.com/go-git/go-billy/v5"
 	"github.com/juju/fslock"
 	"github.com/willscott/go-nfs-client/nfs"
 )
 
+// atx is a transaction on an automerge doc. Operations are queued and
+// then applied all together by Commit: if any of them fails, none of them
+// are applied and a *TxError says which one.
 type atx struct {
 	d   *automerge.Doc
-	ops []func() error
+	fs  *AMFS
+	ops []atxOp
+	// msg is the change message, see Describe
+	msg string
+}
+
+type atxOp struct {
+	name  string
+	path  []any
+	apply func(p *automerge.Path) error
+}
+
+// TxError is returned when an operation in a transaction fails.
+type TxError struct {
+	Op   string
+	Path []any
+	Err  error
+}
+
+func (e *TxError) Error() string {
+	segments := []string{}
+	for _, p := range e.Path {
+		segments = append(segments, fmt.Sprint(p))
+	}
+	return e.Op + " " + strings.Join(segments, "/") + ": " + e.Err.Error()
+}
+
+func (e *TxError) Unwrap() error {
+	return e.Err
 }
 
 func Tx(d *automerge.Doc) *atx {
-	return &atx{d: d, ops: []func() error{}}
+	return &atx{d: d, ops: []atxOp{}}
+}
+
+// Tx starts a transaction on the tree document, Commit will persist it
+// to the data directory.
+// The caller must be inside fs.update.
+func (fs *AMFS) Tx() *atx {
+	return &atx{d: fs.doc, fs: fs, ops: []atxOp{}}
+}
+
+// view runs fn with a consistent snapshot of the tree document.
+// Any number of views can run at once, but none run during an update.
+func (fs *AMFS) view(fn func() error) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fn()
+}
+
+// update runs fn with exclusive access to the tree document. All
+// transactions on the tree must be committed inside an update, so that
+// readers never see them half applied.
+func (fs *AMFS) update(fn func() error) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fn()
 }
 
 func (tx *atx) Commit() error {
+	if tx.fs == nil {
+		return fmt.Errorf("commit: transaction is not attached to a filesystem")
+	}
 	if err := tx.CommitOnly(); err != nil {
 		return err
 	}
 
-	encoder := json.NewEncoder(os.Stdout)
-	encoder.SetIndent("", "  ")
-	encoder.Encode(mustGet(tx.d.RootMap().Values()))
-
-	return os.WriteFile("fs/folder.automerge", tx.d.Save(), 0o666)
+	if err := tx.fs.persist(); err != nil {
+		return err
+	}
+	tx.fs.peers.notify()
+	return nil
 }
 
+// CommitOnly applies the transaction without persisting it.
+// The operations are run against a fork of the doc, which is only merged
+// back once they have all succeeded, so a failure leaves the doc untouched.
 func (tx *atx) CommitOnly() error {
+	scratch, err := tx.d.Fork()
+	if err != nil {
+		return err
+	}
+	if err := scratch.SetActorID(tx.d.ActorID()); err != nil {
+		return err
+	}
 	for _, op := range tx.ops {
-		if err := op(); err != nil {
-			return err
+		if err := op.apply(scratch.Path(op.path...)); err != nil {
+			return &TxError{Op: op.name, Path: op.path, Err: err}
 		}
 	}
-	_, err := tx.d.Commit("")
-	return err
+	if _, err := scratch.Commit(tx.msg); err != nil {
+		return err
+	}
+
+	live := tx.fs != nil && tx.d == tx.fs.doc
+	var before string
+	if live {
+		before = headsKey(tx.d)
+	}
+	if _, err := tx.d.Merge(scratch); err != nil {
+		return err
+	}
+	if live {
+		tx.fs.treeCommitted(before, tx.ops)
+	}
+	return nil
 }
 
 type atxSet struct {
 	tx   *atx
-	path *automerge.Path
+	path []any
+	list bool
 }
 
 func (tx *atx) Set(path ...any) *atxSet {
-	return &atxSet{tx: tx, path: tx.d.Path(path...)}
+	return &atxSet{tx: tx, path: path}
 }
 
 func (txs *atxSet) To(value any) *atx {
-	txs.tx.ops = append(txs.tx.ops, func() error {
-		return txs.path.Set(value)
-	})
+	if txs.list {
+		txs.tx.ops = append(txs.tx.ops, atxOp{name: "append", path: txs.path, apply: func(p *automerge.Path) error {
+			return p.List().Append(value)
+		}})
+		return txs.tx
+	}
+	txs.tx.ops = append(txs.tx.ops, atxOp{name: "set", path: txs.path, apply: func(p *automerge.Path) error {
+		return p.Set(value)
+	}})
 	return txs.tx
 }
 
 func (tx *atx) Inc(path ...any) *atx {
-	p := tx.d.Path(path...)
-	tx.ops = append(tx.ops, func() error {
+	tx.ops = append(tx.ops, atxOp{name: "inc", path: path, apply: func(p *automerge.Path) error {
 		return p.Counter().Inc(1)
-	})
+	}})
 	return tx
 }
 
 func (tx *atx) Del(path ...any) *atx {
-	p := tx.d.Path(path...)
-	tx.ops = append(tx.ops, func() error {
+	tx.ops = append(tx.ops, atxOp{name: "delete", path: path, apply: func(p *automerge.Path) error {
 		return p.Delete()
-	})
+	}})
 	return tx
 }
 
-func mustGet[T any](t T, err error) T {
-	if err != nil {
-		panic(err)
-	}
-	return t
+// Describe sets the message of the change, which says what the operation
+// was (e.g. "rename a/b -> a/c") for anyone looking at the history.
+func (tx *atx) Describe(format string, args ...any) *atx {
+	tx.msg = fmt.Sprintf(format, args...)
+	return tx
+}
+
+// Append adds value to the end of the list at path, creating the list if
+// necessary.
+func (tx *atx) Append(path ...any) *atxSet {
+	return &atxSet{tx: tx, path: path, list: true}
 }
 
 type AMFS struct {
+	// mu guards doc, see view and update.
+	mu  sync.RWMutex
 	doc *automerge.Doc
+	dir string
+	cfg *cfg.Config
+	// lock stops two processes using the same data directory at once
+	lock *fslock.Lock
+	// blobs holds the content of files, see cfg.BlobStore
+	blobs BlobStore
+	// keys encrypts everything stored, or is nil
+	keys *keyring
+	// identity is the daemon's key, see identity.go
+	identity ed25519.PrivateKey
+
+	journal    *journal
+	compacting atomic.Bool
+
+	history historyCache
+	trees   treeCache
+	live    liveTree
+	// peers are the other daemons the tree is replicated to, see peers.go
+	peers peerStates
+	// mergeable holds the docs of mergeable files in use, see sync.go
+	mergeable mergeableDocs
+	// cache tracks the content kept under cfg.ContentBudget, see cache.go
+	cache contentCache
 }
 
 type AMFileSystem struct {
-	Files   map[AMID]*AMFile         `json:"files"`
-	Folders map[AMID]map[string]AMID `json:"folders"`
+	Files    map[AMID]*AMFile         `json:"files"`
+	Folders  map[AMID]map[string]AMID `json:"folders"`
+	Versions map[AMID][]*AMVersion    `json:"versions"`
+	Trash    map[AMID]*AMTrash        `json:"trash"`
 }
 
 type AMID string
@@ -119,15 +243,31 @@ type AMFile struct {
 	ModTime  time.Time `json:"modtime"`
 	ModCount int64     `json:"modcount,omitempty"`
 	Type     AMType    `json:"type"`
-	// For blobs the first head is the sha256 of the current content
+	// For blobs the first head is the sha256 of the current content (or of
+	// the manifest listing its chunks, if it was large enough to be split,
+	// see chunk.go), and any others are versions saved concurrently on
+	// other peers (see conflicts.go).
 	// For mergeables, the heads are from the doc.
 	Heads [][]byte `json:"heads,omitempty"`
+	// Location is where the file is in the tree, see tree.go.
+	Location *AMLocation `json:"loc,omitempty"`
 }
 
 type AMFileInfo struct {
 	name string
 	amid AMID
 	file *AMFile
+	// at is the historical tree the file was found in, or nil if it is in
+	// the current tree. Historical files are read-only.
+	at *automerge.Doc
+	// prefix is the read-only view the file was found through
+	// (.amfs/@<spec>, .amfs/history, .amfs/trash or .amfs/conflicts), or
+	// empty for the current tree.
+	prefix string
+	// version is set for a past version of a file in .amfs/history (or a
+	// concurrent one in .amfs/conflicts), whose file is the version rather
+	// than the current file.
+	version bool
 }
 
 type AMFileHandle struct {
@@ -135,7 +275,11 @@ type AMFileHandle struct {
 	fs   *AMFS
 	file *os.File
 	lock *fslock.Lock
+	// path is what the file was opened as, for change messages
+	path string
 	mode int
+	// release lets the content be evicted again, see holdContent
+	release func()
 }
 
 func newID() AMID {
@@ -149,40 +293,178 @@ func newID() AMID {
 
 var ROOT = AMID("ROOT")
 
-func NewAMFS() *AMFS {
-	bytes, err := os.ReadFile("fs/folder.automerge")
+// folderFile is the name of the tree document within the data directory.
+const folderFile = "folder.automerge"
 
+// NewAMFS opens the filesystem stored in c.DataDir, creating the directory
+// and an empty tree document on first start.
+func NewAMFS(c *cfg.Config) (*AMFS, error) {
+	keys, err := loadKeyring(c)
 	if err != nil {
-		doc := automerge.New()
-		err := Tx(doc).
-			Set("files", ROOT).To(
-			&AMFile{
-				Permissions: 0o777 | os.ModeDir,
-				Type:        Folder,
-				ModTime:     time.Now(),
-			}).
-			Set("files", ROOT, "modcount").To(automerge.NewCounter(1)).
-			Set("folders", ROOT).To(automerge.NewMap()).
-			Commit()
+		return nil, err
+	}
+	return openAMFS(c, keys)
+}
 
-		if err != nil {
-			panic(err)
+// openAMFS is NewAMFS with the encryption keys already loaded.
+func openAMFS(c *cfg.Config, keys *keyring) (*AMFS, error) {
+	if err := os.MkdirAll(c.DataDir, 0o755); err != nil {
+		return nil, err
+	}
+	fs := &AMFS{dir: c.DataDir, cfg: c, keys: keys, lock: fslock.New(filepath.Join(c.DataDir, "lock"))}
+	if err := fs.lock.TryLock(); err != nil {
+		return nil, fmt.Errorf("%s is in use by another amfs: %w", c.DataDir, err)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			if fs.journal != nil {
+				fs.journal.f.Close()
+			}
+			fs.lock.Unlock()
 		}
+	}()
 
-		if err := os.WriteFile("fs/folder.automerge", doc.Save(), 0o666); err != nil {
-			panic(err)
+	doc, recovery, err := fs.loadDoc()
+	if errors.Is(err, os.ErrNotExist) {
+		if doc, err = newTree(); err != nil {
+			return nil, err
 		}
-		bytes, err = os.ReadFile("fs/folder.automerge")
-		if err != nil {
-			panic(err)
+		if err := fs.saveDoc(doc.Save()); err != nil {
+			return nil, err
 		}
+	} else if err != nil {
+		return nil, err
+	}
+	if fs.identity, err = loadIdentity(c.DataDir); err != nil {
+		return nil, err
+	}
+	// changes made here are attributed to the identity
+	if err := doc.SetActorID(publicKey(fs.identity)); err != nil {
+		return nil, err
+	}
+	fs.doc = doc
+
+	if fs.blobs, err = newBlobStore(c, keys); err != nil {
+		return nil, err
+	}
+	if err := fs.loadCache(); err != nil {
+		return nil, err
 	}
 
-	doc, err := automerge.Load(bytes)
+	old, err := readJournalFile(fs.path(oldJournalFile))
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	j, records, err := openJournal(fs.path(journalFile))
+	if err != nil {
+		return nil, err
+	}
+	fs.journal = j
+
+	lost := 0
+	for _, r := range append(old, records...) {
+		r, err := keys.open(journalFile, r)
+		if err != nil {
+			return nil, fmt.Errorf("replaying %s: %w", fs.path(journalFile), err)
+		}
+		before := headsKey(doc)
+		if err := doc.LoadIncremental(r); err != nil {
+			return nil, fmt.Errorf("replaying %s: %w", fs.path(journalFile), err)
+		}
+		// automerge queues changes whose dependencies are missing instead
+		// of failing, so a record that doesn't move the heads is lost
+		if headsKey(doc) == before {
+			lost++
+		}
+	}
+	// the replayed changes are already on disk, don't journal them again
+	doc.SaveIncremental()
+
+	if recovery != nil {
+		recovery.lost = lost
+		if !c.Recover {
+			return nil, recovery
+		}
+		if err := fs.recover(recovery, doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := fs.update(fs.nameActor); err != nil {
+		return nil, err
 	}
-	return &AMFS{doc: doc}
+
+	if len(old) > 0 || j.size > fs.compactBytes() {
+		go fs.compact()
+	}
+	ok = true
+	return fs, nil
+}
+
+// genesisActor is the actor ID of the first change to every tree.
+const genesisActor = "00"
+
+// newTree returns an empty tree document. The first change is the same on
+// every daemon (the same actor, time and operations, and so the same hash),
+// so that trees started separately share ROOT and can be replicated to each
+// other, see peers.go.
+func newTree() (*automerge.Doc, error) {
+	doc := automerge.New()
+	if err := doc.SetActorID(genesisActor); err != nil {
+		return nil, err
+	}
+	// one key at a time, as a struct is written in map order
+	root := []struct {
+		path  []any
+		value any
+	}{
+		{[]any{"files", ROOT}, automerge.NewMap()},
+		{[]any{"files", ROOT, "modcount"}, automerge.NewCounter(1)},
+		{[]any{"files", ROOT, "modtime"}, time.Unix(0, 0).UTC()},
+		{[]any{"files", ROOT, "perm"}, 0o777 | os.ModeDir},
+		{[]any{"files", ROOT, "size"}, int64(0)},
+		{[]any{"files", ROOT, "type"}, Folder},
+		{[]any{"folders", ROOT}, automerge.NewMap()},
+	}
+	for _, r := range root {
+		if err := doc.Path(r.path...).Set(r.value); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := doc.Commit("", automerge.CommitOptions{Time: &time.Time{}}); err != nil {
+		return nil, err
+	}
+	return doc, doc.SetActorID(automerge.NewActorID())
+}
+
+// Close releases the data directory so another process can open it.
+func (fs *AMFS) Close() error {
+	if err := fs.saveCache(); err != nil {
+		fmt.Println("ERROR: saving", fs.path(cacheFile)+":", err)
+	}
+	fs.peers.mu.Lock()
+	for _, f := range fs.peers.fetches {
+		if f.partial != nil {
+			f.partial.mu.Lock()
+			f.partial.f.Close()
+			f.partial.mu.Unlock()
+			f.partial = nil
+		}
+	}
+	fs.peers.mu.Unlock()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.journal.mu.Lock()
+	defer fs.journal.mu.Unlock()
+
+	fs.journal.f.Close()
+	return fs.lock.Unlock()
+}
+
+// path returns the location of name within the data directory
+func (fs *AMFS) path(name string) string {
+	return filepath.Join(fs.dir, name)
 }
 
 // Create creates the named file with mode 0666 (before umask), truncating
@@ -211,68 +493,137 @@ func (fs *AMFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.Fil
 	if flag&os.O_CREATE > 0 {
 		create = Blob
 	}
-	info, err := fs.getFileInfo(filename, create, perm)
+	var info *AMFileInfo
+	var err error
+	if create > 0 && flag&os.O_EXCL > 0 {
+		// checked and created in one update, so that only one of two
+		// exclusive creates of the same name succeeds
+		err = fs.update(func() error {
+			if _, err := fs.lookup(filename, None, 0); err == nil {
+				return pathError("open", filename, nfs.NFS3ErrExist)
+			}
+			info, err = fs.lookup(filename, create, perm)
+			return err
+		})
+	} else {
+		info, err = fs.getFileInfo(filename, create, perm)
+	}
 	if err != nil {
-		return nil, err
+		return nil, toNFSError("open", filename, err)
+	}
+	if info.IsDir() {
+		return nil, pathError("open", filename, nfs.NFS3ErrIsDir)
+	}
+	if info.readOnly() && info.amid != pinsRoot && flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, pathError("open", filename, nfs.NFS3ErrROFS)
 	}
 
+	// the content isn't evicted while the file is open
+	release, err := fs.holdContent(info)
+	if err != nil {
+		return nil, toNFSError("open", filename, err)
+	}
 	file, err := os.CreateTemp("", "")
 	if err != nil {
-		return nil, err
+		release()
+		return nil, toNFSError("open", filename, err)
 	}
-	if len(info.file.Heads) > 0 {
-		if info.file.Type == Blob {
-			content, err := os.ReadFile("fs/" + hex.EncodeToString(info.file.Heads[0]))
-			if err != nil {
-				return nil, err
-			}
-			_, err = file.Write(content)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			saved, err := os.ReadFile("fs/" + string(info.amid))
-			if err != nil {
-				return nil, err
-			}
-			doc, err := automerge.Load(saved)
-			if err != nil {
-				return nil, err
-			}
-
-			content, err := automerge.As[string](doc.Path("content").Get())
-			if err != nil {
-				return nil, err
-			}
-
-			_, err = file.Write([]byte(content))
-			if err != nil {
-				return nil, err
-			}
-		}
+	if err := fs.readContent(info, file); err != nil {
+		release()
+		file.Close()
+		os.Remove(file.Name())
+		return nil, toNFSError("open", filename, err)
 	}
 
 	file.Close()
 	fmt.Println(file.Name())
 
-	if len(info.file.Heads) == 0 && flag&os.O_EXCL > 0 {
+	f, err := os.OpenFile(file.Name(), flag&^(os.O_CREATE|os.O_EXCL), perm)
+	if err != nil {
+		release()
 		os.Remove(file.Name())
+		return nil, toNFSError("open", filename, err)
+	}
+
+	return &AMFileHandle{info: info, fs: fs, file: f, lock: fslock.New(file.Name()), path: filename, mode: flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR), release: release}, nil
+}
+
+// readContent writes the current content of the file to w
+func (fs *AMFS) readContent(info *AMFileInfo, w io.Writer) error {
+	if info.amid == pinsRoot {
+		var data []byte
+		err := fs.view(func() error {
+			var err error
+			data, err = fs.pinsContent()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	if len(info.file.Heads) == 0 {
+		return nil
+	}
+
+	if info.file.Type == Blob {
+		if err := fs.fetchContent(info.file.Heads[0]); err != nil {
+			return err
+		}
+		return fs.copyContent(info.file.Heads[0], w)
 	}
 
-	f, err := os.OpenFile(file.Name(), flag, perm)
+	if err := fs.fetchDoc(info.amid, info.file.Heads); err != nil {
+		return err
+	}
+	saved, err := fs.blobs.Get(string(info.amid))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	doc, err := automerge.Load(saved)
+	if err != nil {
+		return err
+	}
+	if info.at != nil || info.version {
+		if doc, err = forkAt(doc, info.file.Heads); err != nil {
+			return err
+		}
+	}
+
+	content, err := automerge.As[string](doc.Path("content").Get())
+	if err != nil {
+		return err
 	}
 
-	return &AMFileHandle{info: info, fs: fs, file: f, lock: fslock.New(file.Name()), mode: os.O_RDONLY}, nil
+	_, err = w.Write([]byte(content))
+	return err
 }
 
 // Stat returns a FileInfo describing the named file.
 func (fs *AMFS) Stat(filename string) (os.FileInfo, error) {
-	return fs.getFileInfo(filename, 0, 0)
+	info, err := fs.getFileInfo(filename, 0, 0)
+	if err != nil {
+		return nil, toNFSError("stat", filename, err)
+	}
+	return info, nil
+}
+
+func (fs *AMFS) getFileInfo(filename string, create AMType, perm fs.FileMode) (info *AMFileInfo, err error) {
+	lock := fs.view
+	if create > 0 {
+		lock = fs.update
+	}
+	err = lock(func() error {
+		info, err = fs.lookup(filename, create, perm)
+		return err
+	})
+	return info, err
 }
 
-func (fs *AMFS) getFileInfo(filename string, create AMType, perm fs.FileMode) (*AMFileInfo, error) {
+// lookup is getFileInfo for callers already inside view (or update, if
+// create is set).
+func (fs *AMFS) lookup(filename string, create AMType, perm fs.FileMode) (*AMFileInfo, error) {
 	fmt.Println(" > getFileInfo", filename)
 
 	if filename == "" {
@@ -289,27 +640,95 @@ func (fs *AMFS) getFileInfo(filename string, create AMType, perm fs.FileMode) (*
 	path2 := path
 	fmt.Println(" > > navigating...", path)
 
+	// at is the historical tree for .amfs/@<heads-or-time> paths
+	doc := fs.doc
+	var at *automerge.Doc
+	prefix := ""
 	if len(path) >= 2 && path[0] == ".amfs" {
-		if strings.HasPrefix(path[1], "=") {
-			parent = AMID(strings.TrimPrefix(path[1], "="))
+		switch {
+		case strings.HasPrefix(path[1], "="):
+			path2 = path[1:]
+		case strings.HasPrefix(path[1], "@"):
+			if create > 0 {
+				return nil, pathError("lookup", filename, nfs.NFS3ErrROFS)
+			}
+			var err error
+			if at, err = fs.historicalTree(strings.TrimPrefix(path[1], "@")); err != nil {
+				fmt.Println(" > > no history for", path[1], err)
+				return nil, pathError("lookup", filename, nfs.NFS3ErrNoEnt)
+			}
+			doc = at
+			prefix = ".amfs/" + path[1]
+			path2 = path[2:]
+		case path[1] == "history" || path[1] == "conflicts":
+			if create > 0 {
+				return nil, pathError("lookup", filename, nfs.NFS3ErrROFS)
+			}
+			prefix = ".amfs/" + path[1]
+			path2 = path[2:]
+		case path[1] == "pins" && len(path) == 2:
+			return fs.pinsInfo()
+		case path[1] == "trash":
+			if create > 0 {
+				return nil, pathError("lookup", filename, nfs.NFS3ErrROFS)
+			}
+			prefix = trashDir
+			if len(path) == 2 {
+				return fs.trashInfo()
+			}
 			path2 = path[2:]
+			if !strings.HasPrefix(path[2], "=") {
+				e, err := fs.lookupTrash(path[2])
+				if err != nil {
+					return nil, err
+				}
+				parent = e.amid
+				path2 = path[3:]
+			}
+		}
+		// .amfs/=<amid> and .amfs/<view>/=<amid> start from that file, see
+		// handler.ToHandle
+		if len(path2) > 0 && strings.HasPrefix(path2[0], "=") {
+			parent = AMID(strings.TrimPrefix(path2[0], "="))
+			path2 = path2[1:]
 		}
 	} else if len(path) >= 1 && path[0] == ".amfs" {
 		path2 = path[1:]
 	}
 
 	for i, p := range path2 {
-		id, err := automerge.As[AMID](fs.doc.Path("folders", parent, p).Get())
+		typ, err := automerge.As[AMType](doc.Path("files", parent, "type").Get())
 		if err != nil {
 			return nil, err
 		}
-		if id != "" {
+		if typ != Folder {
+			if prefix == historyDir && typ != None && i == len(path2)-1 {
+				return fs.lookupVersion(parent, p)
+			}
+			if prefix == conflictsDir && typ != None && i == len(path2)-1 {
+				return fs.lookupConflict(parent, p)
+			}
+			if typ == None {
+				return nil, pathError("lookup", filename, nfs.NFS3ErrNoEnt)
+			}
+			return nil, pathError("lookup", filename, nfs.NFS3ErrNotDir)
+		}
+
+		t, err := fs.tree(doc)
+		if err != nil {
+			return nil, err
+		}
+		if id := t.lookup(parent, p); id != "" {
 			fmt.Println(" > > found", parent, p)
 			parent = id
 			continue
 		}
 
 		if create > 0 && i == len(path2)-1 {
+			// like a directory that has been rmdir'd while a process is in it
+			if fs.isRemoved(parent) {
+				return nil, pathError("lookup", filename, nfs.NFS3ErrNoEnt)
+			}
 			fmt.Println("CREATING", create, p)
 			id := newID()
 
@@ -317,11 +736,12 @@ func (fs *AMFS) getFileInfo(filename string, create AMType, perm fs.FileMode) (*
 				perm |= os.ModeDir
 			}
 
-			tx := Tx(fs.doc).
+			tx := fs.Tx().
 				Set("files", id).To(&AMFile{
 				Permissions: perm,
 				Type:        create,
 				ModTime:     time.Now(),
+				Location:    &AMLocation{Parent: parent, Name: p, MovedAt: time.Now(), Peer: fs.doc.ActorID()},
 			}).
 				Inc("files", id, "modcount").
 				Set("folders", parent, p).To(id).
@@ -330,86 +750,239 @@ func (fs *AMFS) getFileInfo(filename string, create AMType, perm fs.FileMode) (*
 
 			if create == Folder {
 				tx = tx.Set("folders", id).To(automerge.NewMap())
+			} else {
+				// written to by Close, see AMFile.Heads
+				tx = tx.Set("files", id, "heads").To([]any{})
 			}
 			parent = id
 
-			if err := tx.Commit(); err != nil {
-				panic(err)
+			op := "create"
+			if create == Folder {
+				op = "mkdir"
+			}
+			if err := tx.Describe("%s %s", op, filename).Commit(); err != nil {
+				return nil, err
 			}
-
-			enc := json.NewEncoder(os.Stdout)
-			enc.SetIndent("", " ")
-			enc.Encode(fs.doc.Root().Interface())
 		} else {
 			fmt.Println(" > > not found", parent, p)
-			return nil, os.ErrNotExist
+			return nil, pathError("lookup", filename, nfs.NFS3ErrNoEnt)
 		}
 	}
 
-	file, err := automerge.As[*AMFile](fs.doc.Path("files", parent).Get())
+	file, err := automerge.As[*AMFile](doc.Path("files", parent).Get())
 	fmt.Println(" > > found2", parent, path[len(path)-1], file, err)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if err := settleSize(doc, parent, file); err != nil {
+		return nil, err
 	}
-	return &AMFileInfo{name: path[len(path)-1], amid: parent, file: file}, nil
+	if file == nil {
+		return nil, pathError("lookup", filename, nfs.NFS3ErrNoEnt)
+	}
+	return &AMFileInfo{name: path[len(path)-1], amid: parent, file: file, at: at, prefix: prefix}, nil
 
 }
 
-// Rename renames (moves) oldpath to newpath. If newpath already exists and
-// is not a directory, Rename replaces it. OS-specific restrictions may
-// apply when oldpath and newpath are in different directories.
+// Rename renames (moves) oldpath to newpath, following rename(2):
+//
+//   - if newpath exists it is replaced in the same transaction, so that
+//     there is no moment when it is missing. The replaced file goes to the
+//     trash.
+//   - a directory can only replace an empty directory (ENOTEMPTY otherwise),
+//     and a file can only replace a file (EISDIR or ENOTDIR otherwise).
+//   - a directory can't be moved inside itself (EINVAL).
+//   - renaming a file onto itself does nothing.
+//
+// Renaming a file out of .amfs/trash restores it.
 func (fs *AMFS) Rename(oldpath, newpath string) error {
 	fmt.Println("> Rename", oldpath, newpath)
-	oldparent, oldtarget := filepath.Split(oldpath)
-	newparent, newtarget := filepath.Split(newpath)
-
-	oldinfo, err := fs.getFileInfo(oldparent, 0, 0)
-	if err != nil {
-		return err
-	}
-	newinfo, err := fs.getFileInfo(newparent, 0, 0)
-	if err != nil {
-		return err
+	oldparent, oldtarget := filepath.Split(strings.TrimRight(oldpath, "/"))
+	newparent, newtarget := filepath.Split(strings.TrimRight(newpath, "/"))
+	for _, name := range []string{oldtarget, newtarget} {
+		if name == "" || name == "." || name == ".." {
+			return pathError("rename", oldpath, nfs.NFS3ErrInval)
+		}
 	}
 
-	amid, err := automerge.As[AMID](fs.doc.Path("folders", oldinfo.amid, oldtarget).Get())
-	if err != nil {
-		panic(err)
-	}
+	err := fs.update(func() error {
+		oldinfo, err := fs.lookup(oldparent, 0, 0)
+		if err != nil {
+			return err
+		}
+		newinfo, err := fs.lookup(newparent, 0, 0)
+		if err != nil {
+			return err
+		}
+		// files are restored by renaming them out of the trash
+		if newinfo.readOnly() || oldinfo.readOnly() && oldinfo.prefix != trashDir {
+			return pathError("rename", oldpath, nfs.NFS3ErrROFS)
+		}
+		if !newinfo.IsDir() || !oldinfo.IsDir() {
+			return pathError("rename", oldpath, nfs.NFS3ErrNotDir)
+		}
+		if fs.isRemoved(newinfo.amid) {
+			return pathError("rename", newpath, nfs.NFS3ErrNoEnt)
+		}
+
+		t, err := fs.tree(fs.doc)
+		if err != nil {
+			return err
+		}
+		var amid AMID
+		if oldinfo.amid == trashRoot {
+			e, err := fs.lookupTrash(oldtarget)
+			if err != nil {
+				return err
+			}
+			amid = e.amid
+		} else {
+			amid = t.lookup(oldinfo.amid, oldtarget)
+		}
+		file, err := automerge.As[*AMFile](fs.doc.Path("files", amid).Get())
+		if err != nil {
+			return err
+		}
+		if amid == "" || file == nil {
+			return pathError("rename", oldpath, nfs.NFS3ErrNoEnt)
+		}
 
-	err = Tx(fs.doc).
-		Set("folders", newinfo.amid, newtarget).To(amid).
-		Del("folders", oldinfo.amid, oldtarget).
-		Inc("files", oldinfo.amid, "modcount").
-		Set("files", oldinfo.amid, "modtime").To(time.Now()).
-		Inc("files", newinfo.amid, "modcount").
-		Set("files", newinfo.amid, "modtime").To(time.Now()).
-		Commit()
+		target := t.lookup(newinfo.amid, newtarget)
+		if target == amid {
+			return nil
+		}
+		if file.Type == Folder && t.contains(amid, newinfo.amid) {
+			return pathError("rename", newpath, nfs.NFS3ErrInval)
+		}
+
+		tx := fs.Tx()
+		if target != "" {
+			if tx, err = fs.replace(tx, newinfo.amid, newtarget, target, amid, file); err != nil {
+				return toNFSError("rename", newpath, err)
+			}
+		}
+
+		if oldinfo.amid == trashRoot {
+			tx = tx.Del("trash", amid)
+		} else {
+			tx = tx.
+				Del("folders", oldinfo.amid, oldtarget).
+				Inc("files", oldinfo.amid, "modcount").
+				Set("files", oldinfo.amid, "modtime").To(time.Now())
+		}
+		return tx.
+			Set("files", amid, "loc").To(&AMLocation{
+			Parent:     newinfo.amid,
+			Name:       newtarget,
+			MovedAt:    time.Now(),
+			FromParent: oldinfo.amid,
+			FromName:   oldtarget,
+			Peer:       fs.doc.ActorID(),
+		}).
+			Set("folders", newinfo.amid, newtarget).To(amid).
+			Inc("files", newinfo.amid, "modcount").
+			Set("files", newinfo.amid, "modtime").To(time.Now()).
+			Describe("rename %s -> %s", oldpath, newpath).
+			Commit()
+	})
+	return toNFSError("rename", oldpath, err)
+}
 
+// replace adds the operations that move the target of a rename (parent/name,
+// which is target) to the trash to tx, after checking that file (which is
+// amid) can replace it.
+// The caller must be inside fs.update.
+func (fs *AMFS) replace(tx *atx, parent AMID, name string, target AMID, amid AMID, file *AMFile) (*atx, error) {
+	existing, err := automerge.As[*AMFile](fs.doc.Path("files", target).Get())
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if existing == nil {
+		// a dangling entry, overwriting it is enough
+		return tx, nil
 	}
 
-	return nil
+	switch {
+	case file.Type == Folder && existing.Type != Folder:
+		return nil, nfs.NFS3Error(nfs.NFS3ErrNotDir)
+	case file.Type != Folder && existing.Type == Folder:
+		return nil, nfs.NFS3Error(nfs.NFS3ErrIsDir)
+	case existing.Type == Folder:
+		t, err := fs.tree(fs.doc)
+		if err != nil {
+			return nil, err
+		}
+		if len(t.children[target]) > 0 {
+			return nil, nfs.NFS3Error(nfs.NFS3ErrNotEmpty)
+		}
+	default:
+		if tx, err = fs.carryVersions(tx, target, amid); err != nil {
+			return nil, err
+		}
+	}
+	return fs.trash(tx, parent, name, target), nil
 }
 
-// Remove removes the named file or directory.
+// Remove removes the named file or directory. It is moved to .amfs/trash,
+// from where it can be restored.
+//
+// As with unlink(2) and rmdir(2), removing a name that doesn't exist fails
+// with ENOENT, and removing a directory that isn't empty with ENOTEMPTY.
+// A removed directory can still be looked up by clients that have a handle
+// to it (e.g. their working directory), but nothing can be created in it.
 func (fs *AMFS) Remove(filename string) error {
 	fmt.Println("> Remove", filename)
-	parent, name := filepath.Split(filename)
-	info, err := fs.getFileInfo(parent, 0, 0)
-	if err != nil {
-		return err
-	}
-	if info.file.Type != Folder {
-		return os.ErrInvalid
+	parent, name := filepath.Split(strings.TrimRight(filename, "/"))
+	switch name {
+	case "", ".", "..":
+		return pathError("remove", filename, nfs.NFS3ErrInval)
 	}
+	err := fs.update(func() error {
+		info, err := fs.lookup(parent, 0, 0)
+		if err != nil {
+			return err
+		}
+		// removing a file from the trash purges it
+		if info.amid == trashRoot {
+			e, err := fs.lookupTrash(name)
+			if err != nil {
+				return err
+			}
+			tx, err := fs.purge(fs.Tx(), []AMID{e.amid})
+			if err != nil {
+				return err
+			}
+			return tx.Describe("purge %s", filename).Commit()
+		}
+		if info.readOnly() {
+			return pathError("remove", filename, nfs.NFS3ErrROFS)
+		}
+		if info.file.Type != Folder {
+			return pathError("remove", filename, nfs.NFS3ErrNotDir)
+		}
 
-	return Tx(fs.doc).
-		Del("folders", info.amid, name).
-		Inc("files", info.amid, "modcount").
-		Commit()
+		t, err := fs.tree(fs.doc)
+		if err != nil {
+			return err
+		}
+		amid := t.lookup(info.amid, name)
+		if amid == "" {
+			return pathError("remove", filename, nfs.NFS3ErrNoEnt)
+		}
+		if len(t.children[amid]) > 0 {
+			return pathError("remove", filename, nfs.NFS3ErrNotEmpty)
+		}
+		return fs.trash(fs.Tx(), info.amid, name, amid).Describe("remove %s", filename).Commit()
+	})
+	return toNFSError("remove", filename, err)
+
+}
 
+// isRemoved reports whether amid has been moved to the trash.
+// The caller must be inside fs.view.
+func (fs *AMFS) isRemoved(amid AMID) bool {
+	t, err := fs.tree(fs.doc)
+	return err == nil && t.parent[amid] == trashRoot
 }
 
 // Join joins any number of path elements into a single path, adding a
@@ -444,27 +1017,73 @@ func (fs *AMFS) TempFile(dir, prefix string) (billy.File, error) {
 // directory entries sorted by filename.
 func (fs *AMFS) ReadDir(path string) ([]os.FileInfo, error) {
 	fmt.Println("> ReadDir", path)
-	i, err := fs.Stat(path)
-	if err != nil {
-		return nil, err
-	}
-	info := i.(*AMFileInfo)
-
 	ret := []os.FileInfo{}
 
-	files, err := automerge.As[map[string]AMID](fs.doc.Path("folders", info.amid).Get())
-	if err != nil {
-		return nil, err
-	}
+	err := fs.view(func() error {
+		info, err := fs.lookup(path, 0, 0)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return pathError("readdir", path, nfs.NFS3ErrNotDir)
+		}
+
+		if info.amid == trashRoot {
+			entries, err := fs.trashEntries()
+			for _, e := range entries {
+				ret = append(ret, &AMFileInfo{name: e.name, amid: e.amid, file: e.file, prefix: trashDir})
+			}
+			return err
+		}
+		if info.isVersions() {
+			list := fs.listVersions
+			if info.prefix == conflictsDir {
+				list = fs.listConflicts
+			}
+			versions, err := list(info.amid, info.name)
+			for _, v := range versions {
+				ret = append(ret, v)
+			}
+			return err
+		}
 
-	for n, id := range files {
-		file, err := automerge.As[*AMFile](fs.doc.Path("files", id).Get())
+		doc := fs.doc
+		if info.at != nil {
+			doc = info.at
+		}
+
+		t, err := fs.tree(doc)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if file != nil {
-			ret = append(ret, &AMFileInfo{name: n, amid: id, file: file})
+
+		// .amfs/conflicts only shows what has conflicts
+		var conflicted map[AMID]bool
+		if info.prefix == conflictsDir {
+			if conflicted, err = fs.conflicted(doc); err != nil {
+				return err
+			}
 		}
+
+		for n, id := range t.children[info.amid] {
+			if conflicted != nil && !conflicted[id] {
+				continue
+			}
+			file, err := automerge.As[*AMFile](doc.Path("files", id).Get())
+			if err != nil {
+				return err
+			}
+			if err := settleSize(doc, id, file); err != nil {
+				return err
+			}
+			if file != nil {
+				ret = append(ret, &AMFileInfo{name: n, amid: id, file: file, at: info.at, prefix: info.prefix})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, toNFSError("readdir", path, err)
 	}
 	return ret, nil
 }
@@ -475,8 +1094,13 @@ func (fs *AMFS) ReadDir(path string) ([]os.FileInfo, error) {
 // already a directory, MkdirAll does nothing and returns nil.
 func (fs *AMFS) MkdirAll(filename string, perm os.FileMode) error {
 	fmt.Println("> MkdirAll", filename, perm)
-	fs.getFileInfo(filename, Folder, perm)
-
+	info, err := fs.getFileInfo(filename, Folder, perm)
+	if err != nil {
+		return toNFSError("mkdir", filename, err)
+	}
+	if !info.IsDir() {
+		return pathError("mkdir", filename, nfs.NFS3ErrNotDir)
+	}
 	return nil
 }
 
@@ -518,14 +1142,21 @@ func (*AMFS) Root() string {
 // symbolic link, it changes the mode of the link's target.
 func (fs *AMFS) Chmod(name string, mode os.FileMode) error {
 	fmt.Println("> Chmod", name, mode)
-	info, err := fs.getFileInfo(name, 0, 0)
-	if err != nil {
-		return err
-	}
-	return Tx(fs.doc).
-		Set("files", info.amid, "perm").To(mode).
-		Inc("files", info.amid, "modcount").
-		Commit()
+	err := fs.update(func() error {
+		info, err := fs.lookup(name, 0, 0)
+		if err != nil {
+			return err
+		}
+		if info.readOnly() {
+			return pathError("chmod", name, nfs.NFS3ErrROFS)
+		}
+		return fs.Tx().
+			Set("files", info.amid, "perm").To(mode).
+			Inc("files", info.amid, "modcount").
+			Describe("chmod %v %s", mode, name).
+			Commit()
+	})
+	return toNFSError("chmod", name, err)
 }
 
 // Lchown changes the numeric uid and gid of the named file. If the file is
@@ -549,14 +1180,21 @@ func (*AMFS) Chown(name string, uid, gid int) error {
 // precise time unit.
 func (fs *AMFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
 	fmt.Println("> Chtimes", name, atime, mtime)
-	info, err := fs.getFileInfo(name, 0, 0)
-	if err != nil {
-		return err
-	}
+	err := fs.update(func() error {
+		info, err := fs.lookup(name, 0, 0)
+		if err != nil {
+			return err
+		}
+		if info.readOnly() {
+			return pathError("chtimes", name, nfs.NFS3ErrROFS)
+		}
 
-	return Tx(fs.doc).
-		Inc("files", info.amid, "modcount").
-		Commit()
+		return fs.Tx().
+			Inc("files", info.amid, "modcount").
+			Describe("touch %s", name).
+			Commit()
+	})
+	return toNFSError("chtimes", name, err)
 }
 
 func (f *AMFileInfo) Name() string {
@@ -571,6 +1209,14 @@ func (f *AMFileInfo) Size() int64 {
 
 func (f *AMFileInfo) Mode() fs.FileMode {
 	fmt.Println(" > f.Mode:", f.name)
+	if f.isVersions() {
+		return os.ModeDir | 0o555
+	}
+	// the trash itself can be removed from and renamed out of, and the
+	// pins written to
+	if f.readOnly() && f.amid != trashRoot && f.amid != pinsRoot {
+		return f.file.Permissions &^ 0o222
+	}
 	return f.file.Permissions
 }
 
@@ -579,7 +1225,19 @@ func (f *AMFileInfo) ModTime() time.Time {
 }
 
 func (f *AMFileInfo) IsDir() bool {
-	return f.file.Type == Folder
+	return f.file.Type == Folder || f.isVersions()
+}
+
+// readOnly reports whether the file was found through a read-only view.
+func (f *AMFileInfo) readOnly() bool {
+	return f.prefix != ""
+}
+
+// isVersions reports whether the file is shown as a directory of its past
+// versions, see .amfs/history, or of its concurrent versions, see
+// .amfs/conflicts.
+func (f *AMFileInfo) isVersions() bool {
+	return (f.prefix == historyDir || f.prefix == conflictsDir) && !f.version && f.file.Type != Folder
 }
 
 func (f *AMFileInfo) Sys() any {
@@ -619,24 +1277,48 @@ func (fh *AMFileHandle) Seek(offset int64, whence int) (int64, error) {
 
 func (fh *AMFileHandle) Close() error {
 	fmt.Println("Handle Close")
+	defer fh.release()
 	fh.file.Close()
+	if fh.info.amid == pinsRoot && fh.mode != os.O_RDONLY {
+		defer os.Remove(fh.file.Name())
+		data, err := os.ReadFile(fh.file.Name())
+		if err != nil {
+			return err
+		}
+		return fh.fs.writePins(data)
+	}
+	if fh.info.readOnly() {
+		return os.Remove(fh.file.Name())
+	}
 
-	bytes, err := os.ReadFile(fh.file.Name())
+	file, err := os.Open(fh.file.Name())
 	if err != nil {
 		return err
 	}
-
-	h := sha256.Sum256(bytes)
-
-	if err := os.WriteFile("fs/"+hex.EncodeToString(h[:]), bytes, 0o666); err != nil {
+	head, size, err := fh.fs.writeContent(file)
+	file.Close()
+	if err != nil {
 		return err
 	}
 
-	err = Tx(fh.fs.doc).
-		Set("files", fh.info.amid, "size").To(len(bytes)).
-		Inc("files", fh.info.amid, "modcount").
-		Set("files", fh.info.amid, "heads").To([][]byte{h[:]}).
-		Commit()
+	err = fh.fs.update(func() error {
+		tx := fh.fs.Tx().Inc("files", fh.info.amid, "modcount").Describe("close %s", fh.path)
+		// a file that was only read is left alone, so that it doesn't
+		// replace a version saved concurrently on another peer
+		if old := fh.info.file.Heads; len(old) == 0 || !bytes.Equal(old[0], head) {
+			var err error
+			if tx, err = fh.fs.keepHead(tx, fh.info.amid, head, size); err != nil {
+				return err
+			}
+			tx = fh.fs.recordVersion(tx, fh.info.amid, &AMVersion{
+				ModTime: time.Now(),
+				Size:    size,
+				Type:    Blob,
+				Heads:   [][]byte{head},
+			}).Describe("write %s", fh.path)
+		}
+		return tx.Commit()
+	})
 
 	if err != nil {
 		return err
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ConradIrwin/amfs/cfg"
+	"github.com/automerge/automerge-go"
+	"github.com/willscott/go-nfs-client/nfs"
+)
+
+// testConfig returns the config for a filesystem in a new temporary
+// directory, with its content in memory.
+func testConfig(t *testing.T) *cfg.Config {
+	return &cfg.Config{
+		DataDir:             t.TempDir(),
+		Name:                t.Name(),
+		JournalCompactBytes: 8 * 1024 * 1024,
+		GCGracePeriod:       time.Hour,
+		HistoryRetention:    time.Hour,
+		TrashRetention:      time.Hour,
+		BlobStore:           "memory",
+	}
+}
+
+func openTestFS(t *testing.T, c *cfg.Config) *AMFS {
+	t.Helper()
+	fs, err := NewAMFS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func writeTestFile(t *testing.T, fs *AMFS, name, content string) {
+	t.Helper()
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, fs *AMFS, name string) string {
+	t.Helper()
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDataDir(t *testing.T) {
+	c := testConfig(t)
+	c.BlobStore = "local"
+	c.DataDir = filepath.Join(c.DataDir, "volume")
+	fs := openTestFS(t, c)
+	writeTestFile(t, fs, "a.txt", "hello")
+	fs.Close()
+
+	if _, err := os.Stat(filepath.Join(c.DataDir, folderFile)); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestFS(t, c)
+	defer fs.Close()
+	if got := readTestFile(t, fs, "a.txt"); got != "hello" {
+		t.Fatalf("a.txt = %q", got)
+	}
+}
+
+func TestDataDirsSideBySide(t *testing.T) {
+	a := openTestFS(t, testConfig(t))
+	defer a.Close()
+	b := openTestFS(t, testConfig(t))
+	defer b.Close()
+
+	writeTestFile(t, a, "a.txt", "a")
+	if _, err := b.Stat("a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("b has a.txt: %v", err)
+	}
+}
+
+func TestDataDirLocked(t *testing.T) {
+	c := testConfig(t)
+	fs := openTestFS(t, c)
+	defer fs.Close()
+	if _, err := NewAMFS(c); err == nil {
+		t.Fatal("opened a data directory that is in use")
+	}
+}
+
+func TestRemoveErrors(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	if err := fs.MkdirAll("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, fs, "d/a.txt", "a")
+
+	for _, tc := range []struct {
+		name string
+		code uint32
+	}{
+		{".", nfs.NFS3ErrInval},
+		{"..", nfs.NFS3ErrInval},
+		{"d/.", nfs.NFS3ErrInval},
+		{"d/..", nfs.NFS3ErrInval},
+		{"d", nfs.NFS3ErrNotEmpty},
+		{"missing", nfs.NFS3ErrNoEnt},
+		{"d/a.txt/b", nfs.NFS3ErrNotDir},
+	} {
+		if err := fs.Remove(tc.name); !isNFSError(err, tc.code) {
+			t.Errorf("Remove(%q) = %v, want NFS error %d", tc.name, err, tc.code)
+		}
+	}
+}
+
+func TestOpenExclusive(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := fs.OpenFile("x.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+			if err == nil {
+				err = f.Close()
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		if err == nil {
+			created++
+		} else if !isNFSError(err, nfs.NFS3ErrExist) {
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("created x.txt %d times", created)
+	}
+	if entries, _ := fs.ReadDir(""); len(entries) != 1 {
+		t.Fatalf("%d entries", len(entries))
+	}
+}
+
+func TestRenameErrors(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	for _, dir := range []string{"d", "d/e", "full", "empty"} {
+		if err := fs.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, fs, "a.txt", "a")
+	writeTestFile(t, fs, "full/b.txt", "b")
+
+	for _, tc := range []struct {
+		from, to string
+		code     uint32
+	}{
+		{"d", "full", nfs.NFS3ErrNotEmpty},
+		{"a.txt", "empty", nfs.NFS3ErrIsDir},
+		{"d", "a.txt", nfs.NFS3ErrNotDir},
+		{"d", "d/e/d", nfs.NFS3ErrInval},
+		{"d", "d/d", nfs.NFS3ErrInval},
+		{"missing", "b.txt", nfs.NFS3ErrNoEnt},
+	} {
+		if err := fs.Rename(tc.from, tc.to); !isNFSError(err, tc.code) {
+			t.Errorf("Rename(%q, %q) = %v, want NFS error %d", tc.from, tc.to, err, tc.code)
+		}
+	}
+	if got := readTestFile(t, fs, "full/b.txt"); got != "b" {
+		t.Fatalf("full/b.txt = %q", got)
+	}
+}
+
+func TestRenameReplace(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	writeTestFile(t, fs, "a.txt", "a")
+	writeTestFile(t, fs, "b.txt", "b")
+
+	if err := fs.Rename("a.txt", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, fs, "a.txt"); got != "a" {
+		t.Fatalf("a.txt renamed onto itself = %q", got)
+	}
+
+	if err := fs.Rename("a.txt", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("a.txt still there: %v", err)
+	}
+	if got := readTestFile(t, fs, "b.txt"); got != "a" {
+		t.Fatalf("b.txt = %q", got)
+	}
+	// the file that was replaced is in the trash
+	entries, err := fs.ReadDir(trashDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("trash has %d entries: %v", len(entries), err)
+	}
+	if got := readTestFile(t, fs, trashDir+"/"+entries[0].Name()); got != "b" {
+		t.Fatalf("trashed b.txt = %q", got)
+	}
+
+	// an empty directory can be replaced by another
+	for _, dir := range []string{"d", "d/e", "empty"} {
+		if err := fs.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Rename("d", "empty"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.Stat("empty/e"); err != nil || !info.IsDir() {
+		t.Fatalf("empty/e: %v", err)
+	}
+}
+
+// TestConcurrentOps runs operations from many goroutines at once (run it
+// with -race), and then checks that the tree still makes sense.
+func TestConcurrentOps(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(r *rand.Rand) {
+			defer wg.Done()
+			dir := func() string { return fmt.Sprintf("d%d", r.Intn(3)) }
+			file := func() string { return fmt.Sprintf("%s/f%d", dir(), r.Intn(4)) }
+			// most of these fail, as the files have been moved or removed
+			for i := 0; i < 40; i++ {
+				switch r.Intn(6) {
+				case 0:
+					fs.MkdirAll(dir(), 0o755)
+				case 1:
+					if f, err := fs.Create(file()); err == nil {
+						f.Write([]byte("x"))
+						f.Close()
+					}
+				case 2:
+					fs.Rename(file(), file())
+				case 3:
+					fs.Remove(file())
+				case 4:
+					d := dir()
+					if r.Intn(2) == 0 {
+						fs.Rename(d, dir()+"/"+d)
+					} else {
+						fs.Rename(dir()+"/"+d, d)
+					}
+				case 5:
+					d := dir()
+					entries, _ := fs.ReadDir(d)
+					for _, e := range entries {
+						fs.Stat(d + "/" + e.Name())
+					}
+				}
+			}
+		}(rand.New(rand.NewSource(int64(g))))
+	}
+	wg.Wait()
+
+	fs.view(func() error {
+		tr, err := fs.tree(fs.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := resolveTree(fs.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tr.parent, want.parent) || !reflect.DeepEqual(tr.children, want.children) ||
+			!reflect.DeepEqual(tr.conflicts, want.conflicts) || !reflect.DeepEqual(tr.others, want.others) {
+			t.Fatalf("updated to %v, resolved to %v", tr.children, want.children)
+		}
+		for amid := range tr.parent {
+			p := amid
+			for i := 0; p != ROOT && p != trashRoot; i++ {
+				if i > len(tr.parent) {
+					t.Fatalf("%s is in a cycle", amid)
+				}
+				p = tr.parent[p]
+			}
+			// the trash is listed from fs.doc's trash entries instead
+			if amid != ROOT && tr.parent[amid] != trashRoot &&
+				tr.children[tr.parent[amid]][tr.name[amid]] != amid && tr.conflicts[amid] == "" {
+				t.Fatalf("%s is not listed in %s", amid, tr.parent[amid])
+			}
+		}
+		return nil
+	})
+
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, err := fs.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			if e.IsDir() {
+				walk(path)
+			} else if got := readTestFile(t, fs, path); got != "x" && got != "" {
+				t.Fatalf("%s = %q", path, got)
+			}
+		}
+	}
+	walk("")
+}
+
+func TestTxRollback(t *testing.T) {
+	failing := []struct {
+		name string
+		tx   func(tx *atx) *atx
+	}{
+		{"index beyond end of list", func(tx *atx) *atx {
+			return tx.Set("list", 5).To("x")
+		}},
+		{"delete beyond end of list", func(tx *atx) *atx {
+			return tx.Del("list", 0).Del("list", 0).Del("list", 0)
+		}},
+		{"key of non-map", func(tx *atx) *atx {
+			return tx.Set("str", "key").To("x")
+		}},
+		{"index of non-list", func(tx *atx) *atx {
+			return tx.Set("map", 0).To("x")
+		}},
+		{"increment non-counter", func(tx *atx) *atx {
+			return tx.Inc("str")
+		}},
+		{"key of value set earlier", func(tx *atx) *atx {
+			return tx.Set("new").To("x").Set("new", "key").To("y")
+		}},
+		{"unsupported value", func(tx *atx) *atx {
+			return tx.Set("map", "fn").To(func() {})
+		}},
+	}
+
+	for _, f := range failing {
+		t.Run(f.name, func(t *testing.T) {
+			doc := automerge.New()
+			err := Tx(doc).
+				Set("str").To("s").
+				Set("map", "a").To(1).
+				Append("list").To("x").
+				Append("list").To("y").
+				CommitOnly()
+			if err != nil {
+				t.Fatal(err)
+			}
+			heads := doc.Heads()
+
+			err = f.tx(Tx(doc).Set("map", "b").To(2)).CommitOnly()
+			var txErr *TxError
+			if !errors.As(err, &txErr) {
+				t.Fatalf("got %v, want a TxError", err)
+			}
+			if _, err := doc.Commit("", automerge.CommitOptions{}); err == nil {
+				t.Fatal("operations before the failure were applied")
+			}
+			if len(doc.Heads()) != 1 || doc.Heads()[0] != heads[0] {
+				t.Fatal("doc changed")
+			}
+			if v, _ := doc.Path("map", "b").Get(); v.Kind() != automerge.KindVoid {
+				t.Fatal("map/b was set")
+			}
+		})
+	}
+}
+
+func TestTxListOps(t *testing.T) {
+	doc := automerge.New()
+	err := Tx(doc).
+		Set("files", "a").To(&AMFile{Type: Blob, Heads: [][]byte{{1}, {2}}}).
+		Set("files", "a", "loc").To(&AMLocation{Parent: ROOT, Name: "a"}).
+		Inc("files", "a", "modcount").
+		Set("folders", ROOT, "a").To("a").
+		CommitOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keepHead's pattern: delete every item, then append
+	err = Tx(doc).
+		Del("files", "a", "heads", 1).
+		Del("files", "a", "heads", 0).
+		Append("files", "a", "heads").To([]byte{3}).
+		Set("files", "a", "heads", 1).To([]byte{4}).
+		Del("folders", ROOT, "missing").
+		CommitOnly()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := automerge.As[*AMFile](doc.Path("files", "a").Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Heads) != 2 || file.Heads[0][0] != 3 || file.Heads[1][0] != 4 || file.ModCount != 1 {
+		t.Fatalf("file = %+v", file)
+	}
+}
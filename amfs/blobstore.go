@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ConradIrwin/amfs/cfg"
+)
+
+// BlobStore holds file content: blobs and chunks under their hex sha256,
+// and mergeable documents under their AMID.
+//
+// Missing content is reported with an error that matches fs.ErrNotExist.
+type BlobStore interface {
+	// Get returns the content stored under name.
+	Get(name string) ([]byte, error)
+	// Open returns a reader for the content stored under name, for content
+	// too large to hold in memory.
+	Open(name string) (io.ReadCloser, error)
+	// Put stores data under name, replacing anything already there. Either
+	// the old or the new content is visible afterwards, never a mixture.
+	Put(name string, data []byte) error
+	// Has reports whether anything is stored under name.
+	Has(name string) (bool, error)
+	// Stat returns the size and modification time of the content.
+	Stat(name string) (BlobInfo, error)
+	// Delete removes the content stored under name. Deleting content that
+	// doesn't exist is not an error.
+	Delete(name string) error
+	// List calls fn for all stored content. The names are those used by
+	// the underlying storage, see encryptStore.
+	List(fn func(BlobInfo) error) error
+}
+
+// BlobInfo describes stored content.
+type BlobInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// newBlobStore returns the BlobStore selected by c.BlobStore, wrapped to
+// encrypt content with keys (if set) and compress it as configured.
+func newBlobStore(c *cfg.Config, keys *keyring) (BlobStore, error) {
+	var store BlobStore
+	switch c.BlobStore {
+	case "", "local":
+		store = newLocalStore(c.DataDir)
+	case "memory":
+		store = newMemoryStore()
+	case "s3":
+		if c.S3 == nil {
+			return nil, fmt.Errorf("blob store s3: no S3 config")
+		}
+		s3, err := newS3Store(c.S3)
+		if err != nil {
+			return nil, err
+		}
+		store = s3
+	default:
+		return nil, fmt.Errorf("unknown blob store: %#v", c.BlobStore)
+	}
+	if keys != nil {
+		store = &encryptStore{BlobStore: store, keys: keys}
+	}
+	return newCompressStore(store, c)
+}
+
+// validBlobName prevents names from escaping the store (e.g. "../x").
+func validBlobName(op, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return &os.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// localStore keeps content as files in a directory. It shares the data
+// directory with the tree document, so List only reports names that look
+// like content.
+type localStore struct {
+	dir string
+}
+
+func newLocalStore(dir string) *localStore {
+	return &localStore{dir: dir}
+}
+
+func (s *localStore) path(op, name string) (string, error) {
+	if err := validBlobName(op, name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *localStore) Get(name string) ([]byte, error) {
+	p, err := s.path("get", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (s *localStore) Open(name string) (io.ReadCloser, error) {
+	p, err := s.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *localStore) Put(name string, data []byte) error {
+	p, err := s.path("put", name)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data, 0o644)
+}
+
+func (s *localStore) Has(name string) (bool, error) {
+	_, err := s.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localStore) Stat(name string) (BlobInfo, error) {
+	p, err := s.path("stat", name)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localStore) Delete(name string) error {
+	p, err := s.path("delete", name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *localStore) List(fn func(BlobInfo) error) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !isContentName(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(BlobInfo{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryStore keeps content in memory. It is useful for testing, but
+// everything stored is lost when the process exits.
+type memoryStore struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{blobs: map[string]memoryBlob{}}
+}
+
+func (s *memoryStore) Get(name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.blobs[name]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: name, Err: fs.ErrNotExist}
+	}
+	return bytes.Clone(b.data), nil
+}
+
+func (s *memoryStore) Open(name string) (io.ReadCloser, error) {
+	data, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryStore) Put(name string, data []byte) error {
+	if err := validBlobName("put", name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[name] = memoryBlob{data: bytes.Clone(data), modTime: time.Now()}
+	return nil
+}
+
+func (s *memoryStore) Has(name string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blobs[name]
+	return ok, nil
+}
+
+func (s *memoryStore) Stat(name string) (BlobInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.blobs[name]
+	if !ok {
+		return BlobInfo{}, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return BlobInfo{Name: name, Size: int64(len(b.data)), ModTime: b.modTime}, nil
+}
+
+func (s *memoryStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, name)
+	return nil
+}
+
+func (s *memoryStore) List(fn func(BlobInfo) error) error {
+	s.mu.RLock()
+	infos := make([]BlobInfo, 0, len(s.blobs))
+	for name, b := range s.blobs {
+		infos = append(infos, BlobInfo{Name: name, Size: int64(len(b.data)), ModTime: b.modTime})
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ConradIrwin/amfs/cfg"
+)
+
+// testBlobStore checks the behaviour that every BlobStore must have.
+func testBlobStore(t *testing.T, store BlobStore) {
+	content := []byte(strings.Repeat("amfs ", 1000))
+	sum := sha256.Sum256(content)
+	name := hex.EncodeToString(sum[:])
+
+	if _, err := store.Get(name); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get of missing content: %v", err)
+	}
+	if _, err := store.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Stat of missing content: %v", err)
+	}
+	if ok, err := store.Has(name); ok || err != nil {
+		t.Fatalf("Has of missing content = %v, %v", ok, err)
+	}
+
+	if err := store.Put(name, content); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Get(name); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Get = %d bytes, %v", len(data), err)
+	}
+	r, err := store.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Open = %d bytes, %v", len(data), err)
+	}
+	if ok, err := store.Has(name); !ok || err != nil {
+		t.Fatalf("Has = %v, %v", ok, err)
+	}
+	if _, err := store.Stat(name); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := false
+	err = store.List(func(info BlobInfo) error {
+		listed = listed || info.Size > 0
+		return nil
+	})
+	if err != nil || !listed {
+		t.Fatalf("List found nothing: %v", err)
+	}
+
+	// replacing content
+	if err := store.Put(name, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Get(name); err != nil || string(data) != "new" {
+		t.Fatalf("Get after replacing = %q, %v", data, err)
+	}
+
+	if err := store.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(name); err != nil {
+		t.Fatalf("Delete of missing content: %v", err)
+	}
+	if _, err := store.Get(name); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get after Delete: %v", err)
+	}
+}
+
+// testBlobNames checks that a store refuses names that could escape it.
+func testBlobNames(t *testing.T, store BlobStore) {
+	for _, bad := range []string{"", ".", "..", "../x", "a/b"} {
+		if err := store.Put(bad, []byte("x")); err == nil {
+			t.Fatalf("Put %q succeeded", bad)
+		}
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	store := newLocalStore(t.TempDir())
+	testBlobStore(t, store)
+	testBlobNames(t, store)
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	testBlobStore(t, store)
+	testBlobNames(t, store)
+}
+
+func TestCompressedEncryptedStore(t *testing.T) {
+	c := testConfig(t)
+	c.Compress = true
+	c.EncryptionKey = strings.Repeat("ab", 32)
+	keys, err := loadKeyring(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newBlobStore(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
+
+// TestS3Store runs against an S3-compatible server (e.g. MinIO) if
+// $AMFS_TEST_S3_ENDPOINT and $AMFS_TEST_S3_BUCKET are set. The credentials
+// are taken from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY.
+func TestS3Store(t *testing.T) {
+	endpoint, bucket := os.Getenv("AMFS_TEST_S3_ENDPOINT"), os.Getenv("AMFS_TEST_S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		t.Skip("set $AMFS_TEST_S3_ENDPOINT and $AMFS_TEST_S3_BUCKET to test against S3")
+	}
+	store, err := newS3Store(&cfg.S3Config{Endpoint: endpoint, Bucket: bucket, Prefix: "amfs-test-" + string(newID()[:8]) + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+	testBlobNames(t, store)
+}
+
+func TestMemoryStoreFilesystem(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	writeTestFile(t, fs, "a.txt", "hello")
+	if got := readTestFile(t, fs, "a.txt"); got != "hello" {
+		t.Fatalf("a.txt = %q", got)
+	}
+	// nothing is stored in the data directory
+	err := newLocalStore(fs.dir).List(func(info BlobInfo) error {
+		t.Errorf("%s is in the data directory", info.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptStoreSegments(t *testing.T) {
+	c := testConfig(t)
+	c.EncryptionKey = strings.Repeat("cd", 32)
+	keys, err := loadKeyring(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := newMemoryStore()
+	store := &encryptStore{BlobStore: mem, keys: keys}
+
+	for _, size := range []int{0, 1, encryptSegmentSize - 10, encryptSegmentSize, 3*encryptSegmentSize + 5} {
+		content := bytes.Repeat([]byte{byte(size)}, size)
+		if err := store.Put("x", content); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := store.Get("x"); err != nil || !bytes.Equal(data, content) {
+			t.Fatalf("%d bytes: got %d bytes, %v", size, len(data), err)
+		}
+	}
+
+	// content sealed whole, before it was sealed in segments
+	if err := mem.Put(keys.current().blobName("old"), keys.seal("old", []byte("old content"))); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Get("old"); err != nil || string(data) != "old content" {
+		t.Fatalf("old content = %q, %v", data, err)
+	}
+
+	// cutting off whole segments must be noticed
+	stored := keys.current().blobName("x")
+	sealed, err := mem.Get(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := encryptSegmentSize + keys.current().aead.Overhead()
+	header := len(streamMagic) + keyIDSize + streamPrefixSize
+	for _, cut := range []int{header + segment, header + 2*segment, len(sealed) - 1} {
+		if err := mem.Put(stored, sealed[:cut]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get("x"); err == nil {
+			t.Fatalf("read content cut off at %d of %d bytes", cut, len(sealed))
+		}
+	}
+
+	// and so must content stored under another name
+	if err := mem.Put(keys.current().blobName("y"), sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("y"); err == nil {
+		t.Fatal("read x as y")
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+	"github.com/willscott/go-nfs-client/nfs"
+)
+
+// A daemon with a cfg.ContentBudget doesn't keep a copy of everything in
+// the tree. Content is fetched from peers when it is read (see
+// readContent), and the least recently read content beyond the budget is
+// deleted again by evictContent.
+//
+// Only content that was fetched from a peer is ever evicted, so that the
+// daemon a file was saved on always keeps it. Files and folders can be
+// pinned (with `amfs pin` or by writing their paths to .amfs/pins) to keep
+// their content regardless of the budget, and to fetch it in the
+// background so that it can be read offline.
+
+// pinsFile lists the pinned files and folders, and cacheFile the content
+// that was fetched from peers with when it was last read. They are kept in
+// the data directory and are not replicated.
+const (
+	pinsFile  = "pins"
+	cacheFile = "cache"
+)
+
+// pinsPath is the control file that lists the pinned paths, one per line.
+// Writing a list of paths to it replaces the pins, see writePins.
+const pinsPath = ".amfs/pins"
+
+// pinsDraftTimeout is how long what was written to pinsPath is shown
+// there, so that a client writing it in pieces reads back its own writes.
+const pinsDraftTimeout = time.Minute
+
+// pinsRoot is the AMID of pinsPath, which isn't in the tree.
+const pinsRoot = AMID("PINS")
+
+// cacheInterval is how often content is evicted to fit the budget.
+const cacheInterval = time.Minute
+
+// contentCache tracks what a daemon with a content budget keeps.
+type contentCache struct {
+	mu sync.Mutex
+	// pins are the pinned files and folders
+	pins map[AMID]bool
+	// used holds when each name fetched from a peer was last read
+	used map[string]time.Time
+	// dirty is set when used has changed since it was saved
+	dirty bool
+	// held counts the open files reading each name, which is not evicted
+	// while they are, see holdContent
+	held map[string]int
+	// draft is what was last written to pinsPath, and when
+	draft   []byte
+	draftAt time.Time
+}
+
+// lazy reports whether content is only fetched when it is needed.
+func (fs *AMFS) lazy() bool {
+	return fs.cfg.ContentBudget > 0
+}
+
+// loadCache reads the pins and the record of fetched content.
+func (fs *AMFS) loadCache() error {
+	fs.cache.mu.Lock()
+	defer fs.cache.mu.Unlock()
+	fs.cache.pins = map[AMID]bool{}
+	fs.cache.used = map[string]time.Time{}
+	if err := fs.readLocal(pinsFile, &fs.cache.pins); err != nil {
+		return err
+	}
+	return fs.readLocal(cacheFile, &fs.cache.used)
+}
+
+// saveCache writes the record of fetched content, if it has changed.
+func (fs *AMFS) saveCache() error {
+	fs.cache.mu.Lock()
+	defer fs.cache.mu.Unlock()
+	if !fs.cache.dirty {
+		return nil
+	}
+	if err := fs.writeLocal(cacheFile, fs.cache.used); err != nil {
+		return err
+	}
+	fs.cache.dirty = false
+	return nil
+}
+
+// readLocal decodes the JSON in the data directory file name into v. A
+// missing file leaves v as it is.
+func (fs *AMFS) readLocal(name string, v any) error {
+	data, err := os.ReadFile(fs.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if data, err = fs.keys.open(name, data); err != nil {
+		return fmt.Errorf("reading %s: %w", fs.path(name), err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeLocal replaces the data directory file name with v as JSON.
+func (fs *AMFS) writeLocal(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs.path(name), fs.keys.seal(name, data), 0o666)
+}
+
+// fetched records that name was fetched from a peer, which makes it
+// possible to evict it.
+func (fs *AMFS) fetched(name string) {
+	fs.cache.mu.Lock()
+	defer fs.cache.mu.Unlock()
+	fs.cache.used[name] = time.Now()
+	fs.cache.dirty = true
+}
+
+// touch records that name was read, if it was fetched from a peer.
+func (fs *AMFS) touch(name string) {
+	fs.cache.mu.Lock()
+	defer fs.cache.mu.Unlock()
+	if _, ok := fs.cache.used[name]; ok {
+		fs.cache.used[name] = time.Now()
+		fs.cache.dirty = true
+	}
+}
+
+// holdContent fetches the content of the file and stops it (and its
+// chunks) being evicted until the returned function is called.
+func (fs *AMFS) holdContent(info *AMFileInfo) (func(), error) {
+	if info.amid == pinsRoot || info.file.Type != Blob || len(info.file.Heads) == 0 {
+		return func() {}, nil
+	}
+	head := info.file.Heads[0]
+	if err := fs.fetchContent(head); err != nil {
+		return nil, err
+	}
+	names := []string{hex.EncodeToString(head)}
+	chunks, err := fs.blobChunks(head)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, c := range chunks {
+		names = append(names, hex.EncodeToString(c.Hash))
+	}
+
+	fs.cache.mu.Lock()
+	defer fs.cache.mu.Unlock()
+	if fs.cache.held == nil {
+		fs.cache.held = map[string]int{}
+	}
+	for _, name := range names {
+		fs.cache.held[name]++
+	}
+	return func() {
+		fs.cache.mu.Lock()
+		defer fs.cache.mu.Unlock()
+		for _, name := range names {
+			if fs.cache.held[name]--; fs.cache.held[name] <= 0 {
+				delete(fs.cache.held, name)
+			}
+		}
+	}, nil
+}
+
+// pinned returns the files in the pinned files and folders.
+// The caller must be inside fs.view.
+func (fs *AMFS) pinned() (map[AMID]bool, error) {
+	t, err := fs.tree(fs.doc)
+	if err != nil {
+		return nil, err
+	}
+	fs.cache.mu.Lock()
+	pins := []AMID{}
+	for amid := range fs.cache.pins {
+		pins = append(pins, amid)
+	}
+	fs.cache.mu.Unlock()
+
+	ret := map[AMID]bool{}
+	var add func(amid AMID)
+	add = func(amid AMID) {
+		if ret[amid] {
+			return
+		}
+		ret[amid] = true
+		for _, child := range t.children[amid] {
+			add(child)
+		}
+	}
+	for _, amid := range pins {
+		if _, ok := t.parent[amid]; ok || amid == ROOT {
+			add(amid)
+		}
+	}
+	return ret, nil
+}
+
+// pinListing returns the paths of the pinned files and folders.
+func (fs *AMFS) pinListing() ([]string, error) {
+	var lines []string
+	err := fs.view(func() error {
+		var err error
+		lines, err = fs.pinPaths()
+		return err
+	})
+	return lines, err
+}
+
+// pinPaths is pinListing for callers already inside fs.view.
+func (fs *AMFS) pinPaths() ([]string, error) {
+	t, err := fs.tree(fs.doc)
+	if err != nil {
+		return nil, err
+	}
+	paths := t.paths()
+	lines := []string{}
+	fs.cache.mu.Lock()
+	for amid := range fs.cache.pins {
+		p, ok := paths[amid]
+		if !ok {
+			// in the trash
+			continue
+		}
+		if p == "" {
+			p = "/"
+		}
+		lines = append(lines, p)
+	}
+	fs.cache.mu.Unlock()
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// pin adds (or if unpin is set, removes) the files and folders at paths to
+// the pins.
+func (fs *AMFS) pin(paths []string, unpin bool) error {
+	return fs.setPins(paths, func(pins map[AMID]bool, amid AMID) {
+		if unpin {
+			delete(pins, amid)
+		} else {
+			pins[amid] = true
+		}
+	}, false)
+}
+
+// setPins updates the pins with the files and folders at paths, starting
+// from none if replace is set.
+func (fs *AMFS) setPins(paths []string, fn func(pins map[AMID]bool, amid AMID), replace bool) error {
+	amids := []AMID{}
+	err := fs.view(func() error {
+		for _, p := range paths {
+			info, err := fs.lookup(strings.Trim(p, "/"), 0, 0)
+			if err != nil {
+				return err
+			}
+			if info.readOnly() {
+				return pathError("pin", p, nfs.NFS3ErrROFS)
+			}
+			amids = append(amids, info.amid)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.cache.mu.Lock()
+	pins := map[AMID]bool{}
+	if !replace {
+		for amid := range fs.cache.pins {
+			pins[amid] = true
+		}
+	}
+	for _, amid := range amids {
+		fn(pins, amid)
+	}
+	if err := fs.writeLocal(pinsFile, pins); err != nil {
+		fs.cache.mu.Unlock()
+		return err
+	}
+	fs.cache.pins = pins
+	fs.cache.mu.Unlock()
+
+	// wake prefetch to fetch the newly pinned content
+	fs.peers.notify()
+	return nil
+}
+
+// pinsInfo describes the .amfs/pins control file.
+// The caller must be inside fs.view.
+func (fs *AMFS) pinsInfo() (*AMFileInfo, error) {
+	fs.cache.mu.Lock()
+	n := len(fs.cache.pins)
+	fs.cache.mu.Unlock()
+	data, err := fs.pinsContent()
+	if err != nil {
+		return nil, err
+	}
+	size := len(data)
+	return &AMFileInfo{
+		name: "pins",
+		amid: pinsRoot,
+		file: &AMFile{
+			Permissions: 0o644,
+			Type:        Blob,
+			Size:        int64(size),
+			ModCount:    int64(n),
+		},
+		prefix: pinsPath,
+	}, nil
+}
+
+// pinsContent returns the content of pinsPath: the pinned paths, or what
+// was written there if that was recent.
+func (fs *AMFS) pinsContent() ([]byte, error) {
+	fs.cache.mu.Lock()
+	draft := fs.cache.draft
+	if time.Since(fs.cache.draftAt) > pinsDraftTimeout {
+		draft = nil
+	}
+	fs.cache.mu.Unlock()
+	if draft != nil {
+		return draft, nil
+	}
+	lines, err := fs.pinPaths()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(append(lines, ""), "\n")), nil
+}
+
+// writePins replaces the pins with the paths listed in data, one per line.
+//
+// NFS clients write a file in pieces, and each piece is closed as it is
+// written, so data may only be the start of the list. It is only applied
+// once it ends with a newline and every path in it exists (a file with
+// just a newline removes all the pins); a list that ends with a newline
+// but names a path that doesn't exist is rejected, and the pins are left
+// as they were.
+func (fs *AMFS) writePins(data []byte) error {
+	fs.cache.mu.Lock()
+	fs.cache.draft, fs.cache.draftAt = data, time.Now()
+	fs.cache.mu.Unlock()
+	if len(data) == 0 || data[len(data)-1] != '\n' {
+		return nil
+	}
+
+	lines, err := fs.pinListing()
+	if err != nil {
+		return err
+	}
+	if string(data) == strings.Join(append(lines, ""), "\n") {
+		return nil
+	}
+	paths := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	err = fs.setPins(paths, func(pins map[AMID]bool, amid AMID) {
+		pins[amid] = true
+	}, true)
+	if err != nil {
+		fs.cache.mu.Lock()
+		fs.cache.draft = nil
+		fs.cache.mu.Unlock()
+		fmt.Println("ERROR: not pinning", pinsPath+":", err)
+		return pathError("write", pinsPath, nfs.NFS3ErrInval)
+	}
+	return nil
+}
+
+// cacheLoop evicts content every cacheInterval until ctx is done.
+func (fs *AMFS) cacheLoop(ctx context.Context) {
+	if !fs.lazy() {
+		return
+	}
+	t := time.NewTicker(cacheInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fs.saveCache()
+			return
+		case <-t.C:
+			n, size, err := fs.evictContent()
+			if err != nil {
+				fmt.Println("ERROR: evicting content:", err)
+				continue
+			}
+			if n > 0 {
+				fmt.Println("evicted", n, "blobs,", size, "bytes")
+			}
+		}
+	}
+}
+
+// evictContent deletes the least recently read content that was fetched
+// from peers, and isn't pinned, until what is left fits in the budget. It
+// returns the number of blobs deleted and their size.
+func (fs *AMFS) evictContent() (int, int64, error) {
+	if !fs.lazy() {
+		return 0, 0, nil
+	}
+
+	keep := map[string]bool{}
+	err := fs.view(func() error {
+		pinned, err := fs.pinned()
+		if err != nil {
+			return err
+		}
+		for amid := range pinned {
+			file, err := automerge.As[*AMFile](fs.doc.Path("files", amid).Get())
+			if err != nil {
+				return err
+			}
+			if file == nil || file.Type != Blob {
+				continue
+			}
+			for _, head := range file.Heads {
+				keep[hex.EncodeToString(head)] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for name := range keep {
+		head, _ := hex.DecodeString(name)
+		chunks, err := fs.blobChunks(head)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, 0, err
+		}
+		for _, c := range chunks {
+			keep[hex.EncodeToString(c.Hash)] = true
+		}
+	}
+
+	fs.cache.mu.Lock()
+	used := map[string]time.Time{}
+	for name, t := range fs.cache.used {
+		used[name] = t
+	}
+	fs.cache.mu.Unlock()
+
+	type entry struct {
+		name string
+		used time.Time
+		size int64
+	}
+	entries := []entry{}
+	total := int64(0)
+	gone := []string{}
+	for name, t := range used {
+		info, err := fs.blobs.Stat(name)
+		if errors.Is(err, os.ErrNotExist) {
+			gone = append(gone, name)
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if keep[name] {
+			continue
+		}
+		entries = append(entries, entry{name: name, used: t, size: info.Size})
+		total += info.Size
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+
+	n, size := 0, int64(0)
+	for _, e := range entries {
+		if total <= fs.cfg.ContentBudget {
+			break
+		}
+		// checked as it is deleted, so that a file can't start reading it
+		// in between
+		fs.cache.mu.Lock()
+		held := fs.cache.held[e.name] > 0
+		if !held {
+			err = fs.blobs.Delete(e.name)
+		}
+		fs.cache.mu.Unlock()
+		if held {
+			continue
+		}
+		if err != nil {
+			return n, size, err
+		}
+		gone = append(gone, e.name)
+		total -= e.size
+		n++
+		size += e.size
+	}
+
+	fs.cache.mu.Lock()
+	for _, name := range gone {
+		delete(fs.cache.used, name)
+		fs.cache.dirty = true
+	}
+	fs.cache.mu.Unlock()
+	return n, size, fs.saveCache()
+}
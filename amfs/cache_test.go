@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// writePinsPiece writes data at offset to .amfs/pins as an NFS WRITE does,
+// opening and closing the file around it.
+func writePinsPiece(fs *AMFS, offset int64, data string) error {
+	f, err := fs.OpenFile(pinsPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func TestPinsWrittenInPieces(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	writeTestFile(t, fs, "a.txt", "a")
+	if err := fs.MkdirAll("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePinsPiece(fs, 0, "/a.txt\n/d"); err != nil {
+		t.Fatal(err)
+	}
+	if lines, _ := fs.pinListing(); len(lines) != 0 {
+		t.Fatalf("pinned %v before the list was complete", lines)
+	}
+	if got := readTestFile(t, fs, pinsPath); got != "/a.txt\n/d" {
+		t.Fatalf("%s = %q", pinsPath, got)
+	}
+
+	if err := writePinsPiece(fs, 9, "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if lines, _ := fs.pinListing(); !reflect.DeepEqual(lines, []string{"/a.txt", "/d"}) {
+		t.Fatalf("pinned %v", lines)
+	}
+}
+
+func TestPinsRejected(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	writeTestFile(t, fs, "a.txt", "a")
+	if err := fs.pin([]string{"a.txt"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Create(pinsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("/missing\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err == nil {
+		t.Fatal("pinned a path that doesn't exist")
+	}
+	if lines, _ := fs.pinListing(); !reflect.DeepEqual(lines, []string{"/a.txt"}) {
+		t.Fatalf("pinned %v", lines)
+	}
+	if got := readTestFile(t, fs, pinsPath); got != "/a.txt\n" {
+		t.Fatalf("%s = %q", pinsPath, got)
+	}
+}
+
+func TestEvictSkipsOpenFiles(t *testing.T) {
+	c := testConfig(t)
+	c.ContentBudget = 1
+	fs := openTestFS(t, c)
+	defer fs.Close()
+	writeTestFile(t, fs, "a.txt", "a")
+	info, err := fs.getFileInfo("a.txt", None, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := hex.EncodeToString(info.file.Heads[0])
+	// as if it had come from a peer
+	fs.fetched(name)
+
+	f, err := fs.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := fs.evictContent(); err != nil || n != 0 {
+		t.Fatalf("evicted %d: %v", n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, err := fs.evictContent(); err != nil || n != 1 {
+		t.Fatalf("evicted %d: %v", n, err)
+	}
+	if has, _ := fs.blobs.Has(name); has {
+		t.Fatal("content still stored")
+	}
+}
@@ -2,14 +2,102 @@ package cfg
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 type Config struct {
-	Listen       string
+	Listen string
+	// UnixListen is the socket that commands such as `amfs restore` and
+	// editors use to talk to the daemon. It defaults to amfs.sock in
+	// DataDir, and only the user running the daemon can connect to it.
 	UnixListen   string
 	MountOptions string
 	Mounts       []*Mount
+
+	// PeerListen is where other daemons connect to replicate the tree, or
+	// empty to only connect out to Peers.
+	PeerListen string
+	// Peers lists the PeerListen addresses of the daemons to replicate the
+	// tree with.
+	Peers []string
+	// Name is how changes made by this daemon are described to people, it
+	// defaults to the host name.
+	Name string
+	// PeerKeys lists the public keys (as printed by `amfs identity`) of the
+	// daemons that are trusted to replicate the tree. Connections to or
+	// from any other key are refused.
+	PeerKeys []string
+
+	// ContentBudget is how many bytes of content fetched from peers to
+	// keep. If it is set, content is only fetched when it is read or is in
+	// a pinned folder (see `amfs pin`), and the least recently read content
+	// beyond the budget is deleted. If it is 0, all content is fetched and
+	// kept.
+	ContentBudget int64
+
+	// DataDir is where the tree document and file contents are stored. It
+	// defaults to $AMFS_DATA, or amfs in the user's data directory (see
+	// defaultDataDir), and is set with -data.
+	DataDir string
+	// Recover allows starting from the previous generation of the tree
+	// document if the current one is damaged, losing the changes that only
+	// it had. It is set with -recover.
+	Recover bool
+	// JournalCompactBytes is the size the change journal can grow to before
+	// a new snapshot of the tree document is written.
+	JournalCompactBytes int64
+
+	// GCInterval is how often unreferenced content is deleted, or 0 to
+	// only collect garbage when asked to with `amfs gc`.
+	GCInterval time.Duration
+	// GCGracePeriod is how long content is kept after it is written even
+	// if nothing refers to it.
+	GCGracePeriod time.Duration
+	// HistoryRetention is how long old versions of files are kept, or 0 to
+	// keep them all.
+	HistoryRetention time.Duration
+	// TrashRetention is how long removed files stay in .amfs/trash before
+	// they are purged, or 0 to keep them until they are removed from there.
+	TrashRetention time.Duration
+
+	// BlobStore is where file content is kept: "local" (in DataDir, the
+	// default), "memory" (lost on exit, for testing) or "s3".
+	BlobStore string
+	// S3 configures the "s3" blob store.
+	S3 *S3Config
+
+	// Compress stores content compressed with zstd. Content stored before
+	// it was turned on (or off) can still be read.
+	Compress bool
+	// CompressSkipTypes lists MIME types that are already compressed and
+	// so are stored as is. An entry ending in "/" matches every type with
+	// that prefix.
+	CompressSkipTypes []string
+
+	// EncryptionKey is a hex encoded 256 bit key that everything in DataDir
+	// and the blob store is encrypted with. EncryptionKeyFile names a file
+	// holding the key instead, and is needed for `amfs rotate-key`.
+	EncryptionKey     string
+	EncryptionKeyFile string
+}
+
+// S3Config locates a bucket on S3 or an S3-compatible server such as MinIO.
+// Requests use path-style addressing (https://endpoint/bucket/key).
+type S3Config struct {
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the name of every object.
+	Prefix string
+
+	// AccessKeyID and SecretAccessKey default to $AWS_ACCESS_KEY_ID and
+	// $AWS_SECRET_ACCESS_KEY.
+	AccessKeyID     string
+	SecretAccessKey string
 }
 
 type Mount struct {
@@ -24,18 +112,53 @@ type ctxKeyType string
 var ctxKey = ctxKeyType("amfs.cfg")
 
 func Load(ctx context.Context) (context.Context, error) {
+	dataDir := os.Getenv("AMFS_DATA")
+	if dataDir == "" {
+		var err error
+		if dataDir, err = defaultDataDir(); err != nil {
+			return nil, err
+		}
+	}
 	return context.WithValue(ctx, ctxKey, &Config{
 		Listen:       "localhost:51023",
-		UnixListen:   "/tmp/amfs.sock",
 		MountOptions: "nosuid,noowners,nodev,noac,locallocks", // ,noowners,hard,retrans=1,timeo=5,retry=0,rsize=32768,wsize=32768,local_lock=all",
 		Mounts: []*Mount{{
 			Name:       "test",
 			Mountpoint: "/Users/conrad/0/amfs/test",
 			Source:     "localhost:/test",
 		}},
+		PeerListen:          "localhost:51024",
+		DataDir:             dataDir,
+		JournalCompactBytes: 8 * 1024 * 1024,
+		GCInterval:          time.Hour,
+		GCGracePeriod:       time.Hour,
+		HistoryRetention:    7 * 24 * time.Hour,
+		TrashRetention:      30 * 24 * time.Hour,
+		BlobStore:           "local",
+		Compress:            true,
+		CompressSkipTypes: []string{
+			"image/", "video/", "audio/", "font/woff", "font/woff2",
+			"application/zip", "application/x-gzip", "application/x-rar-compressed",
+			"application/pdf", "application/wasm",
+		},
 	}), nil
 }
 
+// defaultDataDir returns $XDG_DATA_HOME/amfs, or if that isn't set amfs in
+// the directory os.UserConfigDir returns (~/.config on Linux,
+// ~/Library/Application Support on macOS), so that the daemon finds the
+// same data whichever directory it is started from.
+func defaultDataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "amfs"), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("no data directory, set $AMFS_DATA or -data: %w", err)
+	}
+	return filepath.Join(dir, "amfs"), nil
+}
+
 func Get(ctx context.Context) *Config {
 	return ctx.Value(ctxKey).(*Config)
 }
@@ -49,7 +172,14 @@ func Listen(ctx context.Context) string {
 }
 
 func UnixListen(ctx context.Context) string {
-	return Get(ctx).UnixListen
+	if path := Get(ctx).UnixListen; path != "" {
+		return path
+	}
+	return filepath.Join(DataDir(ctx), "amfs.sock")
+}
+
+func DataDir(ctx context.Context) string {
+	return Get(ctx).DataDir
 }
 
 func MountOptions(ctx context.Context) string {
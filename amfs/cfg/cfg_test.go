@@ -0,0 +1,47 @@
+package cfg
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataDir(t *testing.T) {
+	t.Setenv("AMFS_DATA", "")
+	t.Setenv("XDG_DATA_HOME", "/tmp/xdg")
+	ctx, err := Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := DataDir(ctx); got != "/tmp/xdg/amfs" {
+		t.Fatalf("DataDir with $XDG_DATA_HOME = %q", got)
+	}
+
+	t.Setenv("XDG_DATA_HOME", "")
+	t.Setenv("HOME", "/tmp/home")
+	if ctx, err = Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := DataDir(ctx); !filepath.IsAbs(got) || filepath.Base(got) != "amfs" {
+		t.Fatalf("default DataDir = %q", got)
+	}
+
+	t.Setenv("AMFS_DATA", "/tmp/volume")
+	if ctx, err = Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := DataDir(ctx); got != "/tmp/volume" {
+		t.Fatalf("DataDir with $AMFS_DATA = %q", got)
+	}
+}
+
+func TestUnixListen(t *testing.T) {
+	t.Setenv("AMFS_DATA", "/tmp/volume")
+	ctx, err := Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := UnixListen(ctx); got != "/tmp/volume/amfs.sock" {
+		t.Fatalf("default UnixListen = %q", got)
+	}
+}
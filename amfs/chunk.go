@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Large blobs are split into content-defined chunks with FastCDC, so that
+// an edit to part of a file only changes the chunks around it. Each chunk is
+// stored once under its sha256 and the file's head is the sha256 of a
+// manifest listing the chunks in order.
+//
+// Content that fits in a single chunk is stored whole, as it always has been.
+const (
+	minChunk = 256 * 1024
+	avgChunk = 1024 * 1024
+	maxChunk = 4 * 1024 * 1024
+)
+
+// The gear hash shifts left once per byte, so its top bits depend on the
+// last 64 bytes read. Normalized chunking uses a harder mask before the
+// average size and an easier one after it to keep chunk sizes close to
+// avgChunk.
+const (
+	maskS = uint64(1<<22-1) << (64 - 22)
+	maskL = uint64(1<<18-1) << (64 - 18)
+)
+
+// manifestMagic starts every manifest. Content that happens to start with
+// it is always chunked, so that it can't be mistaken for a manifest.
+const manifestMagic = "amfs-manifest-v1\n"
+
+// gear maps each byte to a random value. It must be the same everywhere
+// so that peers pick the same chunk boundaries.
+var gear = func() [256]uint64 {
+	var g [256]uint64
+	seed := uint64(0x616d6673) // "amfs"
+	for i := range g {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		g[i] = z ^ (z >> 31)
+	}
+	return g
+}()
+
+// cutPoint returns the length of the first chunk of data.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minChunk {
+		return n
+	}
+	if n > maxChunk {
+		n = maxChunk
+	}
+	normal := avgChunk
+	if n < normal {
+		normal = n
+	}
+
+	h := uint64(0)
+	i := minChunk
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, maxChunk)}
+}
+
+// next returns the next chunk, or io.EOF once the stream is exhausted.
+func (c *chunker) next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		read, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := cutPoint(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return chunk, nil
+}
+
+// chunkRef is an entry in a manifest.
+type chunkRef struct {
+	Hash []byte
+	Size int64
+}
+
+func encodeManifest(chunks []chunkRef) []byte {
+	b := &bytes.Buffer{}
+	b.WriteString(manifestMagic)
+	for _, c := range chunks {
+		fmt.Fprintf(b, "%s %d\n", hex.EncodeToString(c.Hash), c.Size)
+	}
+	return b.Bytes()
+}
+
+// parseManifest returns the chunks listed in data, or ok=false if data is
+// not a manifest.
+func parseManifest(data []byte) (chunks []chunkRef, ok bool, err error) {
+	if !bytes.HasPrefix(data, []byte(manifestMagic)) {
+		return nil, false, nil
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data[len(manifestMagic):]), "\n"), "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		h, s, found := strings.Cut(line, " ")
+		hash, err := hex.DecodeString(h)
+		if err != nil || !found || len(hash) != sha256.Size {
+			return nil, true, fmt.Errorf("invalid manifest line: %#v", line)
+		}
+		size, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid manifest line: %#v", line)
+		}
+		chunks = append(chunks, chunkRef{Hash: hash, Size: size})
+	}
+	return chunks, true, nil
+}
+
+// writeContent stores the content read from r, returning the head to
+// record in AMFile.Heads and the size of the content.
+func (fs *AMFS) writeContent(r io.Reader) ([]byte, int64, error) {
+	c := newChunker(r)
+	chunks := []chunkRef{}
+	var first []byte
+	size := int64(0)
+
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		h := sha256.Sum256(chunk)
+		if err := fs.writeBlob(h[:], chunk); err != nil {
+			return nil, 0, err
+		}
+		if len(chunks) == 0 {
+			first = chunk
+		}
+		chunks = append(chunks, chunkRef{Hash: h[:], Size: int64(len(chunk))})
+		size += int64(len(chunk))
+	}
+
+	if len(chunks) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:], 0, fs.writeBlob(h[:], nil)
+	}
+	if len(chunks) == 1 && !bytes.HasPrefix(first, []byte(manifestMagic)) {
+		return chunks[0].Hash, size, nil
+	}
+
+	manifest := encodeManifest(chunks)
+	h := sha256.Sum256(manifest)
+	return h[:], size, fs.writeBlob(h[:], manifest)
+}
+
+// writeBlob stores data under its hash, unless it is already stored.
+func (fs *AMFS) writeBlob(hash []byte, data []byte) error {
+	name := hex.EncodeToString(hash)
+
+	// Content that is already stored is written again if it is old enough
+	// that the garbage collector might remove it before the commit that
+	// references it has happened.
+	info, err := fs.blobs.Stat(name)
+	if err == nil && time.Since(info.ModTime) < fs.gcGracePeriod()/2 {
+		return nil
+	}
+	return fs.blobs.Put(name, data)
+}
+
+// copyContent writes the content with the given head to w, reassembling
+// it from its chunks if necessary.
+func (fs *AMFS) copyContent(head []byte, w io.Writer) error {
+	r, err := fs.blobs.Open(hex.EncodeToString(head))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fs.touch(hex.EncodeToString(head))
+
+	br := bufio.NewReader(r)
+	if prefix, _ := br.Peek(len(manifestMagic)); string(prefix) != manifestMagic {
+		_, err = io.Copy(w, br)
+		return err
+	}
+
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return err
+	}
+	chunks, _, err := parseManifest(data)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		if err := fs.copyChunk(c, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *AMFS) copyChunk(c chunkRef, w io.Writer) error {
+	r, err := fs.blobs.Open(hex.EncodeToString(c.Hash))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fs.touch(hex.EncodeToString(c.Hash))
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != c.Size {
+		return fmt.Errorf("chunk %s: expected %d bytes, got %d", hex.EncodeToString(c.Hash), c.Size, n)
+	}
+	return nil
+}
+
+// blobChunks returns the chunks referenced by the blob with the given head,
+// or none if it was stored whole.
+func (fs *AMFS) blobChunks(head []byte) ([]chunkRef, error) {
+	r, err := fs.blobs.Open(hex.EncodeToString(head))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	if prefix, _ := br.Peek(len(manifestMagic)); string(prefix) != manifestMagic {
+		return nil, nil
+	}
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	chunks, _, err := parseManifest(data)
+	return chunks, err
+}
+
+// verifyContent checks that the content with the given head, and each of
+// its chunks, is stored and has the right hash.
+func (fs *AMFS) verifyContent(head []byte) error {
+	data, err := fs.blobs.Get(hex.EncodeToString(head))
+	if err != nil {
+		return err
+	}
+	if h := sha256.Sum256(data); !bytes.Equal(h[:], head) {
+		return fmt.Errorf("content %s hashes to %s", hex.EncodeToString(head), hex.EncodeToString(h[:]))
+	}
+
+	chunks, _, err := parseManifest(data)
+	if err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		chunk, err := fs.blobs.Get(hex.EncodeToString(c.Hash))
+		if err != nil {
+			return fmt.Errorf("chunk %s: %w", hex.EncodeToString(c.Hash), err)
+		}
+		if h := sha256.Sum256(chunk); !bytes.Equal(h[:], c.Hash) || int64(len(chunk)) != c.Size {
+			return fmt.Errorf("chunk %s hashes to %s (%d bytes)", hex.EncodeToString(c.Hash), hex.EncodeToString(h[:]), len(chunk))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// chunks splits data as writeContent does.
+func chunks(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	c := newChunker(bytes.NewReader(data))
+	ret := [][]byte{}
+	for {
+		chunk, err := c.next()
+		if err != nil {
+			break
+		}
+		ret = append(ret, chunk)
+	}
+	return ret
+}
+
+func TestChunkBoundaries(t *testing.T) {
+	if n := len(chunks(t, make([]byte, minChunk))); n != 1 {
+		t.Fatalf("split %d bytes into %d chunks", minChunk, n)
+	}
+	// with no content to cut at, chunks are as large as they can be
+	for i, c := range chunks(t, make([]byte, 2*maxChunk+1)) {
+		if want := []int{maxChunk, maxChunk, 1}[i]; len(c) != want {
+			t.Fatalf("chunk %d of zeros is %d bytes", i, len(c))
+		}
+	}
+
+	_, data := testBlob(t, 8*avgChunk)
+	split := chunks(t, data)
+	if !bytes.Equal(bytes.Join(split, nil), data) {
+		t.Fatal("chunks don't add up to the content")
+	}
+	for i, c := range split[:len(split)-1] {
+		if len(c) < minChunk || len(c) > maxChunk {
+			t.Fatalf("chunk %d is %d bytes", i, len(c))
+		}
+	}
+
+	// an insertion at the start only changes the chunks around it
+	edited := chunks(t, append([]byte("inserted"), data...))
+	same := map[[32]byte]bool{}
+	for _, c := range split {
+		same[sha256.Sum256(c)] = true
+	}
+	changed := 0
+	for _, c := range edited {
+		if !same[sha256.Sum256(c)] {
+			changed++
+		}
+	}
+	if changed > 1 {
+		t.Fatalf("%d of %d chunks changed", changed, len(edited))
+	}
+}
+
+func TestChunkedContent(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	_, data := testBlob(t, 3*avgChunk)
+	writeTestFile(t, fs, "a.bin", string(data))
+	if got := readTestFile(t, fs, "a.bin"); got != string(data) {
+		t.Fatalf("read %d bytes of %d", len(got), len(data))
+	}
+
+	info, err := fs.getFileInfo("a.bin", None, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := info.file.Heads[0]
+	a, err := fs.blobChunks(head)
+	if err != nil || len(a) < 2 {
+		t.Fatalf("a.bin has %d chunks: %v", len(a), err)
+	}
+	manifest, err := fs.blobs.Get(hex.EncodeToString(head))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := sha256.Sum256(manifest); !bytes.Equal(h[:], head) {
+		t.Fatal("head is not the hash of the manifest")
+	}
+
+	// b.bin shares all but the last chunk of a.bin, which are stored once
+	before := storedBlobs(t, fs)
+	writeTestFile(t, fs, "b.bin", string(data)+"more")
+	info, err = fs.getFileInfo("b.bin", None, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.blobChunks(info.file.Heads[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range a[:len(a)-1] {
+		if !bytes.Equal(a[i].Hash, b[i].Hash) {
+			t.Fatalf("chunk %d differs", i)
+		}
+	}
+	added := 0
+	for name := range storedBlobs(t, fs) {
+		if !before[name] {
+			added++
+		}
+	}
+	// its last chunk and its manifest
+	if added != 2 {
+		t.Fatalf("b.bin added %d blobs", added)
+	}
+	if got := readTestFile(t, fs, "b.bin"); got != string(data)+"more" {
+		t.Fatalf("read %d bytes of b.bin", len(got))
+	}
+}
+
+func TestManifestLookalike(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	content := manifestMagic + "0000 1\n"
+	writeTestFile(t, fs, "a.txt", content)
+	if got := readTestFile(t, fs, "a.txt"); got != content {
+		t.Fatalf("a.txt = %q", got)
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/ConradIrwin/amfs/cfg"
+)
+
+// runCommand runs an `amfs <name> [args]` subcommand against the data
+// directory. The daemon must not be running.
+func runCommand(ctx context.Context, name string, args []string) error {
+	switch name {
+	case "gc":
+		return gcCommand(ctx, args)
+	case "stats":
+		return statsCommand(ctx, args)
+	case "fsck":
+		return fsckCommand(ctx, args)
+	case "rotate-key":
+		return rotateKeyCommand(ctx, args)
+	case "restore":
+		return restoreCommand(ctx, args)
+	case "resolve":
+		return resolveCommand(ctx, args)
+	case "log":
+		return logCommand(ctx, args)
+	case "identity":
+		return identityCommand(ctx, args)
+	case "pin":
+		return pinCommand(ctx, "pin", args)
+	case "unpin":
+		return pinCommand(ctx, "unpin", args)
+	default:
+		return fmt.Errorf("unknown command: %s", name)
+	}
+}
+
+func gcCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list the content that would be removed without removing it")
+	flags.Parse(args)
+
+	fs, err := NewAMFS(cfg.Get(ctx))
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	stats, err := fs.collectGarbage(*dryRun)
+	if err != nil {
+		return err
+	}
+	fmt.Println("gc:", stats)
+	return nil
+}
+
+func statsCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.Parse(args)
+
+	fs, err := NewAMFS(cfg.Get(ctx))
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	stats, err := fs.compressionStats()
+	if err != nil {
+		return err
+	}
+	fmt.Println("compression:", stats)
+	return nil
+}
+
+// rotateKeyCommand adds a new key to cfg.EncryptionKeyFile, re-encrypts
+// everything with it and then removes the old keys. If the key file
+// doesn't exist yet it is created, and the existing unencrypted data is
+// encrypted.
+func rotateKeyCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	plaintext := flags.Bool("encrypt-plaintext", false, "also encrypt data that was stored before encryption was turned on")
+	flags.Parse(args)
+
+	c := cfg.Get(ctx)
+	if c.EncryptionKeyFile == "" {
+		return fmt.Errorf("rotate-key: EncryptionKeyFile is not configured")
+	}
+	old, err := readKeyFile(c.EncryptionKeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		*plaintext = true
+	} else if err != nil {
+		return err
+	}
+
+	// keep the old keys until everything has been re-encrypted, so that an
+	// interrupted rotation can be run again
+	masters := append([][]byte{newMasterKey()}, old...)
+	if err := writeKeyFile(c.EncryptionKeyFile, masters); err != nil {
+		return err
+	}
+	keys, err := loadKeyring(c)
+	if err != nil {
+		return err
+	}
+	keys.allowPlaintext = *plaintext
+
+	fs, err := openAMFS(c, keys)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	count, err := fs.rotateKeys()
+	if err != nil {
+		return err
+	}
+	if err := writeKeyFile(c.EncryptionKeyFile, masters[:1]); err != nil {
+		return err
+	}
+	fmt.Println("rotate-key:", count, "objects re-encrypted")
+	return nil
+}
+
+// fsckCommand checks the filesystem. If the daemon is running the check is
+// run by it, on the live filesystem.
+func fsckCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "move orphaned files to /lost+found and drop dangling entries")
+	flags.Parse(args)
+
+	if c, err := net.Dial("unix", cfg.UnixListen(ctx)); err == nil {
+		defer c.Close()
+		return remoteFsck(c, *repair)
+	}
+
+	fs, err := NewAMFS(cfg.Get(ctx))
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	report, err := fs.fsck(*repair)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		fmt.Println("fsck:", p)
+	}
+	fmt.Println("fsck:", report)
+	if n := report.unresolved(); n > 0 {
+		return fmt.Errorf("fsck: %d problems remain", n)
+	}
+	return nil
+}
+
+func remoteFsck(c net.Conn, repair bool) error {
+	cmd := "FSCK"
+	if repair {
+		cmd += " repair"
+	}
+	if _, err := c.Write([]byte(cmd + "\n")); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		kind, tail, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		switch kind {
+		case "FSCK":
+			fmt.Println("fsck:", tail)
+		case "FSCKED":
+			n, summary, _ := strings.Cut(tail, " ")
+			fmt.Println("fsck:", summary)
+			if n != "0" {
+				return fmt.Errorf("fsck: %s problems remain", n)
+			}
+			return nil
+		default:
+			return fmt.Errorf("fsck: %s", tail)
+		}
+	}
+}
+
+// restoreCommand moves a file out of the trash, back to where it was
+// removed from or to the given path. With no arguments it lists the trash.
+// If the daemon is running the restore is done by it.
+func restoreCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: amfs restore [<name in .amfs/trash> [<path to restore to>]]")
+	}
+	flags.Parse(args)
+	if flags.NArg() > 2 {
+		flags.Usage()
+		return fmt.Errorf("restore: too many arguments")
+	}
+
+	if c, err := net.Dial("unix", cfg.UnixListen(ctx)); err == nil {
+		defer c.Close()
+		return remoteRestore(c, flags.Arg(0), flags.Arg(1))
+	}
+
+	fs, err := NewAMFS(cfg.Get(ctx))
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	if flags.NArg() == 0 {
+		lines, err := fs.trashListing()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return nil
+	}
+
+	path, err := fs.restore(flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Println("restore: restored", flags.Arg(0), "to", path)
+	return nil
+}
+
+func remoteRestore(c net.Conn, name, dest string) error {
+	cmd := "TRASH"
+	if name != "" {
+		cmd = "RESTORE " + name + "\t" + dest
+	}
+	if _, err := c.Write([]byte(cmd + "\n")); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		kind, tail, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		switch kind {
+		case "TRASH":
+			fmt.Println(tail)
+		case "TRASHED":
+			return nil
+		case "RESTORED":
+			fmt.Println("restore: restored", name, "to", tail)
+			return nil
+		default:
+			return fmt.Errorf("restore: %s", tail)
+		}
+	}
+}
+
+// resolveCommand keeps the given file out of a set of conflict copies and
+// moves the rest to the trash. With no arguments it lists the conflicts.
+// If the daemon is running the conflict is resolved by it.
+func resolveCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("resolve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: amfs resolve [<path of the file to keep>]")
+	}
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("resolve: too many arguments")
+	}
+
+	if c, err := net.Dial("unix", cfg.UnixListen(ctx)); err == nil {
+		defer c.Close()
+		return remoteResolve(c, flags.Arg(0))
+	}
+
+	fs, err := NewAMFS(cfg.Get(ctx))
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	if flags.NArg() == 0 {
+		lines, err := fs.conflictListing()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return nil
+	}
+
+	path, err := fs.resolveConflict(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println("resolve: kept", flags.Arg(0), "as", path)
+	return nil
+}
+
+func remoteResolve(c net.Conn, path string) error {
+	cmd := "CONFLICTS"
+	if path != "" {
+		cmd = "RESOLVE " + path
+	}
+	if _, err := c.Write([]byte(cmd + "\n")); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		kind, tail, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		switch kind {
+		case "CONFLICT":
+			fmt.Println(tail)
+		case "CONFLICTED":
+			return nil
+		case "RESOLVED":
+			fmt.Println("resolve: kept", path, "as", tail)
+			return nil
+		default:
+			return fmt.Errorf("resolve: %s", tail)
+		}
+	}
+}
+
+// logCommand prints the most recent changes to the tree, with who made
+// them.
+// If the daemon is running the changes are read from it.
+func logCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("log", flag.ExitOnError)
+	n := flags.Int("n", 20, "the number of changes to show")
+	flags.Parse(args)
+
+	if c, err := net.Dial("unix", cfg.UnixListen(ctx)); err == nil {
+		defer c.Close()
+		return remoteLog(c, *n)
+	}
+
+	fs, err := NewAMFS(cfg.Get(ctx))
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	lines, err := fs.changeLog(*n)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func remoteLog(c net.Conn, n int) error {
+	if _, err := c.Write([]byte(fmt.Sprintf("LOG %d\n", n))); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		kind, tail, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		switch kind {
+		case "CHANGE":
+			fmt.Println(tail)
+		case "LOGGED":
+			return nil
+		default:
+			return fmt.Errorf("log: %s", tail)
+		}
+	}
+}
+
+// identityCommand prints the public key of the daemon, for the PeerKeys of
+// the daemons it replicates with. The identity is created if necessary.
+func identityCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("identity", flag.ExitOnError)
+	flags.Parse(args)
+
+	dir := cfg.DataDir(ctx)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	priv, err := loadIdentity(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Println(publicKey(priv))
+	return nil
+}
+
+// pinCommand pins (or unpins) the given files and folders, so that their
+// content is kept on this daemon, see cache.go. With no arguments it lists
+// the pins.
+// If the daemon is running the pins are changed by it.
+func pinCommand(ctx context.Context, name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: amfs "+name+" [<path>...]")
+	}
+	flags.Parse(args)
+	if name == "unpin" && flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("unpin: no paths")
+	}
+
+	if c, err := net.Dial("unix", cfg.UnixListen(ctx)); err == nil {
+		defer c.Close()
+		return remotePin(c, name, flags.Args())
+	}
+
+	fs, err := NewAMFS(cfg.Get(ctx))
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	if flags.NArg() > 0 {
+		if err := fs.pin(flags.Args(), name == "unpin"); err != nil {
+			return err
+		}
+	}
+	lines, err := fs.pinListing()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func remotePin(c net.Conn, name string, paths []string) error {
+	cmds := []string{}
+	for _, p := range paths {
+		cmds = append(cmds, strings.ToUpper(name)+" "+p+"\n")
+	}
+	cmds = append(cmds, "PINS\n")
+	if _, err := c.Write([]byte(strings.Join(cmds, ""))); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		kind, tail, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		switch kind {
+		case "PINNED", "UNPINNED":
+		case "PIN":
+			fmt.Println(tail)
+		case "PINS":
+			return nil
+		default:
+			return fmt.Errorf("%s: %s", name, tail)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ConradIrwin/amfs/cfg"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Objects written through a compressStore start with a header giving the
+// codec and the length of the content:
+//
+//	"\xffAMZ" codec:uint8 length:uint64
+//
+// Objects written before compression existed have no header and are read
+// as they are.
+const compressMagic = "\xffAMZ"
+const compressHeaderSize = len(compressMagic) + 1 + 8
+
+const (
+	codecNone = 0
+	codecZstd = 1
+)
+
+// compressStore compresses content on its way into another BlobStore.
+type compressStore struct {
+	BlobStore
+	enabled   bool
+	skipTypes []string
+
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newCompressStore(next BlobStore, c *cfg.Config) (*compressStore, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &compressStore{
+		BlobStore: next,
+		enabled:   c.Compress,
+		skipTypes: c.CompressSkipTypes,
+		encoder:   encoder,
+		decoder:   decoder,
+	}, nil
+}
+
+// shouldCompress reports whether data is worth trying to compress.
+func (s *compressStore) shouldCompress(data []byte) bool {
+	if !s.enabled || len(data) < 64 {
+		return false
+	}
+	mime, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	for _, t := range s.skipTypes {
+		if mime == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mime, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *compressStore) Put(name string, data []byte) error {
+	codec := byte(codecNone)
+	body := data
+	if s.shouldCompress(data) {
+		compressed := s.encoder.EncodeAll(data, nil)
+		// content that doesn't shrink much was probably compressed already
+		if len(compressed) < len(data)-len(data)/20 {
+			codec = codecZstd
+			body = compressed
+		}
+	}
+
+	buf := make([]byte, compressHeaderSize, compressHeaderSize+len(body))
+	copy(buf, compressMagic)
+	buf[len(compressMagic)] = codec
+	binary.BigEndian.PutUint64(buf[len(compressMagic)+1:], uint64(len(data)))
+	return s.BlobStore.Put(name, append(buf, body...))
+}
+
+func (s *compressStore) Get(name string) ([]byte, error) {
+	data, err := s.BlobStore.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	codec, length, ok := parseCompressHeader(data)
+	if !ok {
+		return data, nil
+	}
+
+	body := data[compressHeaderSize:]
+	switch codec {
+	case codecNone:
+	case codecZstd:
+		body, err = s.decoder.DecodeAll(body, make([]byte, 0, length))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing %s: %w", name, err)
+		}
+	default:
+		return nil, fmt.Errorf("decompressing %s: unknown codec %d", name, codec)
+	}
+	if uint64(len(body)) != length {
+		return nil, fmt.Errorf("decompressing %s: expected %d bytes, got %d", name, length, len(body))
+	}
+	return body, nil
+}
+
+func (s *compressStore) Open(name string) (io.ReadCloser, error) {
+	r, err := s.BlobStore.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, compressHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.Close()
+		return nil, err
+	}
+	codec, _, ok := parseCompressHeader(header[:n])
+	if !ok {
+		return readCloser{io.MultiReader(bytes.NewReader(header[:n]), r), r.Close}, nil
+	}
+
+	switch codec {
+	case codecNone:
+		return r, nil
+	case codecZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return readCloser{d, func() error { d.Close(); return r.Close() }}, nil
+	default:
+		r.Close()
+		return nil, fmt.Errorf("decompressing %s: unknown codec %d", name, codec)
+	}
+}
+
+// contentSize returns the size of the content stored under name before
+// it was compressed.
+func (s *compressStore) contentSize(name string) (int64, error) {
+	r, err := s.BlobStore.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	header := make([]byte, compressHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if _, length, ok := parseCompressHeader(header[:n]); ok {
+		return int64(length), nil
+	}
+	// the stored size includes the encryption overhead, if any
+	rest, err := io.Copy(io.Discard, r)
+	return int64(n) + rest, err
+}
+
+func parseCompressHeader(data []byte) (codec byte, length uint64, ok bool) {
+	if len(data) < compressHeaderSize || string(data[:len(compressMagic)]) != compressMagic {
+		return 0, 0, false
+	}
+	return data[len(compressMagic)], binary.BigEndian.Uint64(data[len(compressMagic)+1:]), true
+}
+
+// readCloser combines a reader with a function to close it.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
+
+// compressStats describes how much space compression is saving.
+type compressStats struct {
+	Objects     int
+	StoredBytes int64
+	ContentSize int64
+}
+
+func (s *compressStats) String() string {
+	saved := s.ContentSize - s.StoredBytes
+	percent := 0.0
+	if s.ContentSize > 0 {
+		percent = 100 * float64(saved) / float64(s.ContentSize)
+	}
+	return fmt.Sprintf("%d objects, %d bytes of content stored in %d bytes (%d bytes, %.1f%% saved)",
+		s.Objects, s.ContentSize, s.StoredBytes, saved, percent)
+}
+
+// compressionStats reads the header of all live content to find out how
+// much space compression is saving.
+func (fs *AMFS) compressionStats() (*compressStats, error) {
+	cs, ok := fs.blobs.(*compressStore)
+	if !ok {
+		return nil, fmt.Errorf("content is not stored compressed")
+	}
+	live, err := fs.liveContent()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &compressStats{}
+	for name := range live {
+		info, err := cs.Stat(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, err := cs.contentSize(name)
+		if err != nil {
+			return nil, err
+		}
+		stats.Objects++
+		stats.StoredBytes += info.Size
+		stats.ContentSize += size
+	}
+	return stats, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readCompressed checks that the content stored under name reads back as
+// content through all of the compressStore's methods.
+func readCompressed(t *testing.T, s *compressStore, name string, content []byte) {
+	t.Helper()
+	if data, err := s.Get(name); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Get %s = %d bytes of %d, %v", name, len(data), len(content), err)
+	}
+	r, err := s.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Open %s = %d bytes of %d, %v", name, len(data), len(content), err)
+	}
+	if size, err := s.contentSize(name); err != nil || size != int64(len(content)) {
+		t.Fatalf("contentSize %s = %d of %d, %v", name, size, len(content), err)
+	}
+}
+
+func TestCompressStore(t *testing.T) {
+	c := testConfig(t)
+	c.Compress = true
+	mem := newMemoryStore()
+	s, err := newCompressStore(mem, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, random := testBlob(t, 4096)
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		codec   byte
+	}{
+		{"text", []byte(strings.Repeat("amfs ", 1000)), codecZstd},
+		{"random", random, codecNone},
+		{"small", []byte("amfs"), codecNone},
+		{"empty", nil, codecNone},
+	} {
+		if err := s.Put(tc.name, tc.content); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := mem.Get(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec, length, ok := parseCompressHeader(stored)
+		if !ok || codec != tc.codec || length != uint64(len(tc.content)) {
+			t.Fatalf("%s stored with codec %d, length %d (header %v)", tc.name, codec, length, ok)
+		}
+		if tc.codec == codecZstd && len(stored) >= len(tc.content)/10 {
+			t.Fatalf("%s compressed to %d bytes of %d", tc.name, len(stored), len(tc.content))
+		}
+		readCompressed(t, s, tc.name, tc.content)
+	}
+}
+
+func TestCompressStoreUncompressed(t *testing.T) {
+	c := testConfig(t)
+	mem := newMemoryStore()
+	s, err := newCompressStore(mem, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored before compression existed, including content shorter than
+	// the header and content that only starts like one
+	for name, content := range map[string][]byte{
+		"text":   []byte(strings.Repeat("amfs ", 1000)),
+		"short":  []byte("amfs"),
+		"empty":  nil,
+		"header": []byte(compressMagic + "\x01"),
+	} {
+		if err := mem.Put(name, content); err != nil {
+			t.Fatal(err)
+		}
+		readCompressed(t, s, name, content)
+	}
+
+	// with compression off, content is stored with the header anyway so
+	// that turning it on later can't misread it
+	content := []byte(strings.Repeat("amfs ", 1000))
+	if err := s.Put("off", content); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := mem.Get("off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec, _, ok := parseCompressHeader(stored); !ok || codec != codecNone {
+		t.Fatalf("stored with codec %d (header %v)", codec, ok)
+	}
+	readCompressed(t, s, "off", content)
+}
+
+func TestCompressBeforeEncrypt(t *testing.T) {
+	c := testConfig(t)
+	c.Compress = true
+	c.EncryptionKey = strings.Repeat("ab", 32)
+	keys, err := loadKeyring(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newBlobStore(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// encrypted content doesn't compress, so it must be compressed first
+	s, ok := store.(*compressStore)
+	if !ok {
+		t.Fatalf("content stored through a %T", store)
+	}
+	enc, ok := s.BlobStore.(*encryptStore)
+	if !ok {
+		t.Fatalf("compressed content stored through a %T", s.BlobStore)
+	}
+
+	content := []byte(strings.Repeat("amfs ", 1000))
+	if err := s.Put("text", content); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := enc.BlobStore.Get(keys.current().blobName("text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) >= len(content)/10 {
+		t.Fatalf("stored %d bytes of %d", len(sealed), len(content))
+	}
+	if bytes.Contains(sealed, []byte("amfs amfs")) {
+		t.Fatal("content stored in the clear")
+	}
+	readCompressed(t, s, "text", content)
+
+	// encrypted before compression existed
+	if err := enc.Put("old", content); err != nil {
+		t.Fatal(err)
+	}
+	readCompressed(t, s, "old", content)
+}
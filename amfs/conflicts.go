@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/automerge/automerge-go"
+	"github.com/willscott/go-nfs-client/nfs"
+)
+
+// When a blob is saved on two peers at once, both heads are kept in
+// AMFile.Heads (see AMFileHandle.Close). Readers get the first, which is
+// the same on every peer, and the others are shown in .amfs/conflicts,
+// which mirrors the parts of the tree that have them:
+//
+//	.amfs/conflicts/src/logo.png/20230601T150405Z-3f2a9c1b7e04.png
+//
+// Saving new content replaces all of its heads, as does `amfs resolve`
+// with either the file (to keep what readers see) or one of the versions
+// in .amfs/conflicts (to keep that instead).
+const conflictsDir = ".amfs/conflicts"
+
+// blobConflicts returns the versions of a blob other than the one readers
+// get, or none if there is only one.
+func blobConflicts(doc *automerge.Doc, amid AMID, file *AMFile) ([]*AMVersion, error) {
+	if file.Type != Blob || len(file.Heads) < 2 {
+		return nil, nil
+	}
+	versions, err := automerge.As[[]*AMVersion](doc.Path("versions", amid).Get())
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*AMVersion{}
+	for _, head := range file.Heads[1:] {
+		v := &AMVersion{ModTime: file.ModTime, Size: file.Size, Type: Blob, Heads: [][]byte{head}}
+		for _, w := range versions {
+			if w != nil && len(w.Heads) > 0 && bytes.Equal(w.Heads[0], head) {
+				v = w
+			}
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// settleSize sets the size of a blob with concurrent versions to the size
+// of the one readers get, as the size saved alongside it may be from
+// another.
+func settleSize(doc *automerge.Doc, amid AMID, file *AMFile) error {
+	if file == nil || file.Type != Blob || len(file.Heads) < 2 {
+		return nil
+	}
+	versions, err := automerge.As[[]*AMVersion](doc.Path("versions", amid).Get())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if v != nil && len(v.Heads) > 0 && bytes.Equal(v.Heads[0], file.Heads[0]) {
+			file.Size = v.Size
+		}
+	}
+	return nil
+}
+
+// conflicted returns the blobs with concurrent versions in doc, and the
+// folders that contain them.
+func (fs *AMFS) conflicted(doc *automerge.Doc) (map[AMID]bool, error) {
+	files, err := automerge.As[map[AMID]*AMFile](doc.Path("files").Get())
+	if err != nil {
+		return nil, err
+	}
+	t, err := fs.tree(doc)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[AMID]bool{}
+	for amid, f := range files {
+		if f == nil || f.Type != Blob || len(f.Heads) < 2 {
+			continue
+		}
+		for a := amid; !ret[a]; a = t.parent[a] {
+			ret[a] = true
+			if _, ok := t.parent[a]; !ok {
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// listConflicts returns the concurrent versions of the file, as shown in
+// .amfs/conflicts.
+// The caller must be inside fs.view.
+func (fs *AMFS) listConflicts(amid AMID, name string) ([]*AMFileInfo, error) {
+	file, err := automerge.As[*AMFile](fs.doc.Path("files", amid).Get())
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, pathError("readdir", name, nfs.NFS3ErrNoEnt)
+	}
+	versions, err := blobConflicts(fs.doc, amid, file)
+	if err != nil {
+		return nil, err
+	}
+
+	taken := map[string]bool{}
+	ret := []*AMFileInfo{}
+	for _, v := range versions {
+		ret = append(ret, &AMFileInfo{
+			name: versionName(v, filepath.Ext(name), taken),
+			amid: amid,
+			file: &AMFile{
+				Permissions: file.Permissions,
+				Size:        v.Size,
+				ModTime:     v.ModTime,
+				Type:        Blob,
+				Heads:       v.Heads,
+			},
+			prefix:  conflictsDir,
+			version: true,
+		})
+	}
+	return ret, nil
+}
+
+// lookupConflict finds the concurrent version of the file called name.
+// The caller must be inside fs.view.
+func (fs *AMFS) lookupConflict(amid AMID, name string) (*AMFileInfo, error) {
+	versions, err := fs.listConflicts(amid, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.name == name {
+			return v, nil
+		}
+	}
+	return nil, pathError("lookup", name, nfs.NFS3ErrNoEnt)
+}
+
+// conflictListing describes the conflict copies in the tree (see tree.go),
+// one line per copy.
+func (fs *AMFS) conflictListing() ([]string, error) {
+	lines := []string{}
+	err := fs.view(func() error {
+		t, err := fs.tree(fs.doc)
+		if err != nil {
+			return err
+		}
+		paths := t.paths()
+		for amid, winner := range t.conflicts {
+			p, ok := paths[amid]
+			if !ok {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s\tconflicts with %s", p, paths[winner]))
+		}
+
+		files, err := automerge.As[map[AMID]*AMFile](fs.doc.Path("files").Get())
+		if err != nil {
+			return err
+		}
+		for amid, f := range files {
+			p, ok := paths[amid]
+			if !ok || f == nil || f.Type != Blob || len(f.Heads) < 2 {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s\t%d concurrent versions in %s%s", p, len(f.Heads)-1, conflictsDir, p))
+		}
+		return nil
+	})
+	sort.Strings(lines)
+	return lines, err
+}
+
+// resolveConflict keeps the file at path and discards what it conflicts
+// with. It returns the path of the kept file.
+//
+// If path is a conflict copy, or the file that the copies conflict with,
+// the rest are moved to the trash and a kept copy takes the name it
+// conflicted over. To keep every copy, rename them instead.
+//
+// If path is a blob with concurrent versions, or one of those versions in
+// .amfs/conflicts, the blob is left with just that version.
+func (fs *AMFS) resolveConflict(path string) (string, error) {
+	var kept string
+	err := fs.update(func() error {
+		info, err := fs.lookup(path, 0, 0)
+		if err != nil {
+			return err
+		}
+		t, err := fs.tree(fs.doc)
+		if err != nil {
+			return err
+		}
+
+		if info.prefix == conflictsDir && info.version ||
+			!info.readOnly() && info.file.Type == Blob && len(info.file.Heads) > 1 {
+			kept = t.paths()[info.amid]
+			tx, err := fs.keepHead(fs.Tx(), info.amid, info.file.Heads[0], info.file.Size)
+			if err != nil {
+				return err
+			}
+			return tx.
+				Inc("files", info.amid, "modcount").
+				Set("files", info.amid, "modtime").To(time.Now()).
+				Describe("resolve %s", path).
+				Commit()
+		}
+		if info.readOnly() {
+			return pathError("resolve", path, nfs.NFS3ErrROFS)
+		}
+
+		winner, ok := t.conflicts[info.amid]
+		if !ok {
+			winner = info.amid
+		}
+		parent := t.parent[winner]
+		names := map[AMID]string{}
+		for name, amid := range t.children[parent] {
+			if amid == winner || t.conflicts[amid] == winner {
+				names[amid] = name
+			}
+		}
+		if len(names) < 2 {
+			return fmt.Errorf("resolve %s: no conflicts", path)
+		}
+
+		tx := fs.Tx()
+		for _, amid := range sortedAMIDs(names) {
+			if amid != info.amid {
+				tx = fs.trash(tx, parent, names[amid], amid)
+			}
+		}
+		kept = t.paths()[parent] + "/" + names[winner]
+		if info.amid != winner {
+			tx = tx.
+				Set("files", info.amid, "loc").To(&AMLocation{
+				Parent:     parent,
+				Name:       names[winner],
+				MovedAt:    time.Now(),
+				FromParent: parent,
+				FromName:   names[info.amid],
+				Peer:       fs.doc.ActorID(),
+			}).
+				Set("folders", parent, names[winner]).To(info.amid)
+		}
+		return tx.Describe("resolve %s", path).Commit()
+	})
+	return kept, err
+}
+
+// keepHead adds the operations that replace the heads of a blob with head
+// to tx. The heads are replaced one by one rather than as a whole list, so
+// that a version saved concurrently on another peer is kept alongside this
+// one.
+// The caller must be inside fs.update.
+func (fs *AMFS) keepHead(tx *atx, amid AMID, head []byte, size int64) (*atx, error) {
+	tx, err := fs.setHeads(tx, amid, [][]byte{head})
+	if err != nil {
+		return nil, err
+	}
+	return tx.Set("files", amid, "size").To(size), nil
+}
+
+// setHeads adds the operations that replace the heads of amid with heads
+// to tx, one by one as keepHead does.
+// The caller must be inside fs.update.
+func (fs *AMFS) setHeads(tx *atx, amid AMID, heads [][]byte) (*atx, error) {
+	old, err := automerge.As[[][]byte](fs.doc.Path("files", amid, "heads").Get())
+	if err != nil {
+		return nil, err
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		tx = tx.Del("files", amid, "heads", i)
+	}
+	for _, head := range heads {
+		tx = tx.Append("files", amid, "heads").To(head)
+	}
+	return tx, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/ConradIrwin/amfs/cfg"
+)
+
+// mergeTestFS gives a the tree and content of b, as syncing with b would.
+func mergeTestFS(t *testing.T, a, b *AMFS) {
+	t.Helper()
+	err := b.blobs.List(func(info BlobInfo) error {
+		data, err := b.blobs.Get(info.Name)
+		if err != nil {
+			return err
+		}
+		return a.blobs.Put(info.Name, data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.view(func() error {
+		return a.update(func() error {
+			if _, err := a.doc.Merge(b.doc); err != nil {
+				return err
+			}
+			return a.persist()
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var conflictCopy = regexp.MustCompile(`^notes \(conflict from [0-9a-f]{8} \d{8}T\d{6}Z\)\.txt$`)
+
+// testNameConflict creates notes.txt on two filesystems at once, and
+// returns the first (opened with c) with both, and the name of the
+// conflict copy.
+func testNameConflict(t *testing.T, c *cfg.Config) (*AMFS, string) {
+	a := openTestFS(t, c)
+	b := openTestFS(t, testConfig(t))
+	defer b.Close()
+	writeTestFile(t, a, "notes.txt", "from a")
+	writeTestFile(t, b, "notes.txt", "from b")
+	mergeTestFS(t, a, b)
+
+	entries, err := a.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	dup := ""
+	for _, e := range entries {
+		names = append(names, e.Name())
+		if conflictCopy.MatchString(e.Name()) {
+			dup = e.Name()
+		}
+	}
+	if len(names) != 2 || dup == "" {
+		t.Fatalf("listed %q", names)
+	}
+	return a, dup
+}
+
+func TestNameConflict(t *testing.T) {
+	fs, dup := testNameConflict(t, testConfig(t))
+	defer fs.Close()
+
+	got := map[string]bool{readTestFile(t, fs, "notes.txt"): true, readTestFile(t, fs, dup): true}
+	if !got["from a"] || !got["from b"] {
+		t.Fatalf("read %v", got)
+	}
+	if lines, err := fs.conflictListing(); err != nil || len(lines) != 1 {
+		t.Fatalf("conflicts %q: %v", lines, err)
+	}
+}
+
+func TestNameConflictRenamed(t *testing.T) {
+	fs, dup := testNameConflict(t, testConfig(t))
+	defer fs.Close()
+	want := readTestFile(t, fs, dup)
+
+	if err := fs.Rename(dup, "other.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, fs, "other.txt"); got != want {
+		t.Fatalf("other.txt = %q", got)
+	}
+	if lines, err := fs.conflictListing(); err != nil || len(lines) != 0 {
+		t.Fatalf("conflicts %q: %v", lines, err)
+	}
+}
+
+func TestNameConflictRemoved(t *testing.T) {
+	fs, dup := testNameConflict(t, testConfig(t))
+	defer fs.Close()
+	want := readTestFile(t, fs, "notes.txt")
+
+	if err := fs.Remove(dup); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := fs.ReadDir(""); len(entries) != 1 {
+		t.Fatalf("%d entries left", len(entries))
+	}
+	if got := readTestFile(t, fs, "notes.txt"); got != want {
+		t.Fatalf("notes.txt = %q", got)
+	}
+	if lines, err := fs.conflictListing(); err != nil || len(lines) != 0 {
+		t.Fatalf("conflicts %q: %v", lines, err)
+	}
+}
+
+func TestResolveNameConflict(t *testing.T) {
+	fs, dup := testNameConflict(t, testConfig(t))
+	defer fs.Close()
+	want := readTestFile(t, fs, dup)
+
+	kept, err := fs.resolveConflict(dup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept != "/notes.txt" {
+		t.Fatalf("kept %s", kept)
+	}
+	entries, err := fs.ReadDir("")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("%d entries left: %v", len(entries), err)
+	}
+	if got := readTestFile(t, fs, "notes.txt"); got != want {
+		t.Fatalf("notes.txt = %q", got)
+	}
+	if trashed, _ := fs.ReadDir(trashDir); len(trashed) != 1 {
+		t.Fatalf("%d files in the trash", len(trashed))
+	}
+	if _, err := fs.resolveConflict("notes.txt"); err == nil {
+		t.Fatal("resolved a file without conflicts")
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	c := testConfig(t)
+	c.BlobStore = "local"
+	fs, dup := testNameConflict(t, c)
+	want := readTestFile(t, fs, dup)
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("AMFS_DATA", c.DataDir)
+	ctx, err := cfg.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveCommand(ctx, []string{dup}); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = openTestFS(t, c)
+	defer fs.Close()
+	if entries, _ := fs.ReadDir(""); len(entries) != 1 {
+		t.Fatalf("%d entries left", len(entries))
+	}
+	if got := readTestFile(t, fs, "notes.txt"); got != want {
+		t.Fatalf("notes.txt = %q", got)
+	}
+}
+
+// TestResolveRemote resolves a conflict as amfs resolve does when the
+// daemon is running.
+func TestResolveRemote(t *testing.T) {
+	fs, dup := testNameConflict(t, testConfig(t))
+	defer fs.Close()
+	want := readTestFile(t, fs, dup)
+
+	c, s := net.Pipe()
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveConn(ctx, s, fs)
+
+	if err := remoteResolve(c, "missing.txt"); err == nil {
+		t.Fatal("resolved a file that doesn't exist")
+	}
+	if err := remoteResolve(c, dup); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, fs, "notes.txt"); got != want {
+		t.Fatalf("notes.txt = %q", got)
+	}
+}
+
+func TestResolveBlobVersions(t *testing.T) {
+	a := openTestFS(t, testConfig(t))
+	defer a.Close()
+	b := openTestFS(t, testConfig(t))
+	defer b.Close()
+	writeTestFile(t, a, "v.txt", "first")
+	mergeTestFS(t, b, a)
+	// both save v.txt at once
+	writeTestFile(t, a, "v.txt", "from a")
+	writeTestFile(t, b, "v.txt", "from b")
+	mergeTestFS(t, a, b)
+
+	versions, err := a.ReadDir(conflictsDir + "/v.txt")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("%d concurrent versions: %v", len(versions), err)
+	}
+	other := conflictsDir + "/v.txt/" + versions[0].Name()
+	want := readTestFile(t, a, other)
+	if got := readTestFile(t, a, "v.txt"); got == want || want != "from a" && want != "from b" {
+		t.Fatalf("read %q, and %q in %s", got, want, conflictsDir)
+	}
+
+	if _, err := a.resolveConflict(other); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, a, "v.txt"); got != want {
+		t.Fatalf("v.txt = %q", got)
+	}
+	info, err := a.getFileInfo("v.txt", None, 0)
+	if err != nil || len(info.file.Heads) != 1 {
+		t.Fatalf("v.txt heads %v: %v", info.file.Heads, err)
+	}
+	if lines, err := a.conflictListing(); err != nil || len(lines) != 0 {
+		t.Fatalf("conflicts %q: %v", lines, err)
+	}
+}
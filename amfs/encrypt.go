@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/ConradIrwin/amfs/cfg"
+)
+
+// Encrypted objects (the tree document, each journal record, and content
+// written before content was sealed in segments) are sealed with
+// AES-256-GCM:
+//
+//	"\xffAME" key-id:[8]byte nonce:[12]byte ciphertext
+//
+// The magic and key ID are authenticated along with the ciphertext. The
+// plaintext starts with the uvarint-prefixed name of the object, so that an
+// object can't be passed off as another one, and so that key rotation can
+// find the name of everything it re-encrypts.
+const encryptMagic = "\xffAME"
+const keyIDSize = 8
+
+// Content in the blob store is sealed in segments instead, so that it can
+// be decrypted as it is read:
+//
+//	"\xffAMS" key-id:[8]byte nonce-prefix:[7]byte segment...
+//
+// Each segment is up to encryptSegmentSize bytes of plaintext, sealed with
+// the nonce nonce-prefix counter:uint32 last:byte, where last is 1 only for
+// the final segment, so segments can't be reordered, dropped or cut off
+// without failing to decrypt. Only the final segment is shorter than
+// encryptSegmentSize. The header is authenticated with every segment, and
+// as for seal the plaintext starts with the name of the object.
+const streamMagic = "\xffAMS"
+const streamPrefixSize = 7
+const encryptSegmentSize = 64 * 1024
+
+// encryptionKey is derived from a 256 bit master key. Separate subkeys are
+// used for encryption and for naming content.
+type encryptionKey struct {
+	id    []byte
+	aead  cipher.AEAD
+	names []byte
+}
+
+func newEncryptionKey(master []byte) (*encryptionKey, error) {
+	if len(master) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, not %d", len(master))
+	}
+	block, err := aes.NewCipher(hmacSHA256(master, "amfs content"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionKey{
+		id:    hmacSHA256(master, "amfs key id")[:keyIDSize],
+		aead:  aead,
+		names: hmacSHA256(master, "amfs names"),
+	}, nil
+}
+
+// blobName returns the name content is stored under: a keyed hash, so that
+// the store doesn't reveal the sha256 of the content it holds.
+func (k *encryptionKey) blobName(name string) string {
+	return hex.EncodeToString(hmacSHA256(k.names, name))
+}
+
+// keyring holds the current key, used for writing, and older keys that
+// are still accepted for reading while a rotation is in progress.
+//
+// A nil *keyring means encryption is turned off; its methods pass data
+// through unchanged.
+type keyring struct {
+	keys []*encryptionKey
+	// allowPlaintext accepts objects that were written before encryption
+	// was turned on. It is only set by `amfs rotate-key`.
+	allowPlaintext bool
+}
+
+// loadKeyring returns the keys configured by c.EncryptionKey or
+// c.EncryptionKeyFile, or nil if encryption is not configured.
+func loadKeyring(c *cfg.Config) (*keyring, error) {
+	var masters [][]byte
+	switch {
+	case c.EncryptionKey != "" && c.EncryptionKeyFile != "":
+		return nil, fmt.Errorf("only one of EncryptionKey and EncryptionKeyFile can be set")
+	case c.EncryptionKey != "":
+		master, err := hex.DecodeString(c.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EncryptionKey: %w", err)
+		}
+		masters = [][]byte{master}
+	case c.EncryptionKeyFile != "":
+		var err error
+		if masters, err = readKeyFile(c.EncryptionKeyFile); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+
+	k := &keyring{}
+	for _, master := range masters {
+		key, err := newEncryptionKey(master)
+		if err != nil {
+			return nil, err
+		}
+		k.keys = append(k.keys, key)
+	}
+	return k, nil
+}
+
+// readKeyFile reads hex encoded keys, one per line. The first is the
+// current key. Blank lines and lines starting with # are ignored.
+func readKeyFile(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	masters := [][]byte{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		master, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %w", path, i+1, err)
+		}
+		masters = append(masters, master)
+	}
+	if len(masters) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return masters, nil
+}
+
+// writeKeyFile replaces the key file with the given keys, current first.
+func writeKeyFile(path string, masters [][]byte) error {
+	b := &strings.Builder{}
+	b.WriteString("# amfs encryption keys: the first is current, the rest are only used for reading\n")
+	for _, master := range masters {
+		b.WriteString(hex.EncodeToString(master) + "\n")
+	}
+	return writeFileAtomic(path, []byte(b.String()), 0o600)
+}
+
+func (k *keyring) current() *encryptionKey {
+	return k.keys[0]
+}
+
+// storedNames returns every name that the named object could be stored
+// under, for the current key first.
+func (k *keyring) storedNames(name string) []string {
+	if k == nil {
+		return []string{name}
+	}
+	names := []string{}
+	for _, key := range k.keys {
+		names = append(names, key.blobName(name))
+	}
+	if k.allowPlaintext {
+		names = append(names, name)
+	}
+	return names
+}
+
+// seal encrypts data with the current key.
+func (k *keyring) seal(name string, data []byte) []byte {
+	if k == nil {
+		return data
+	}
+	key := k.current()
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	plaintext := binary.AppendUvarint(nil, uint64(len(name)))
+	plaintext = append(plaintext, name...)
+	plaintext = append(plaintext, data...)
+
+	header := append([]byte(encryptMagic), key.id...)
+	out := append(append([]byte{}, header...), nonce...)
+	return key.aead.Seal(out, nonce, plaintext, header)
+}
+
+// open decrypts the object called name.
+func (k *keyring) open(name string, data []byte) ([]byte, error) {
+	if k == nil {
+		return data, nil
+	}
+	sealedName, plaintext, err := k.unseal(data)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", name, err)
+	}
+	if sealedName != name && sealedName != "" {
+		return nil, fmt.Errorf("decrypting %s: object is %s", name, sealedName)
+	}
+	return plaintext, nil
+}
+
+// sealStream encrypts data with the current key in segments, see
+// streamMagic.
+func (k *keyring) sealStream(name string, data []byte) []byte {
+	key := k.current()
+	header := append([]byte(streamMagic), key.id...)
+	header = append(header, make([]byte, streamPrefixSize)...)
+	if _, err := rand.Read(header[len(header)-streamPrefixSize:]); err != nil {
+		panic(err)
+	}
+
+	plaintext := binary.AppendUvarint(nil, uint64(len(name)))
+	plaintext = append(plaintext, name...)
+	plaintext = append(plaintext, data...)
+
+	segments := len(plaintext)/encryptSegmentSize + 1
+	out := make([]byte, 0, len(header)+len(plaintext)+segments*key.aead.Overhead())
+	out = append(out, header...)
+	for i := uint32(0); ; i++ {
+		segment := plaintext
+		if len(segment) > encryptSegmentSize {
+			segment = segment[:encryptSegmentSize]
+		}
+		plaintext = plaintext[len(segment):]
+		last := len(plaintext) == 0
+		out = key.aead.Seal(out, streamNonce(header, i, last), segment, header)
+		if last {
+			return out
+		}
+	}
+}
+
+func streamNonce(header []byte, counter uint32, last bool) []byte {
+	nonce := append([]byte{}, header[len(header)-streamPrefixSize:]...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// openStream returns a reader that decrypts the object called name as it
+// is read from r. Objects sealed whole (by seal) are decrypted at once.
+func (k *keyring) openStream(name string, r io.Reader) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, encryptSegmentSize+64)
+	magic, err := br.Peek(len(streamMagic))
+	if err != nil || string(magic) != streamMagic {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		data, err = k.open(name, data)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+
+	s, sealedName, err := k.newStreamReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", name, err)
+	}
+	if sealedName != name {
+		return nil, fmt.Errorf("decrypting %s: object is %s", name, sealedName)
+	}
+	return s, nil
+}
+
+// streamReader decrypts segments as they are read.
+type streamReader struct {
+	r       *bufio.Reader
+	key     *encryptionKey
+	header  []byte
+	counter uint32
+	// buf is the decrypted part of the segment that hasn't been read yet
+	buf  []byte
+	done bool
+}
+
+// newStreamReader reads the header and first segment of a stream, and
+// returns the name it was sealed with.
+func (k *keyring) newStreamReader(r *bufio.Reader) (*streamReader, string, error) {
+	header := make([]byte, len(streamMagic)+keyIDSize+streamPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, "", fmt.Errorf("truncated")
+	}
+	id := header[len(streamMagic) : len(streamMagic)+keyIDSize]
+	s := &streamReader{r: r, header: header}
+	for _, key := range k.keys {
+		if bytes.Equal(key.id, id) {
+			s.key = key
+		}
+	}
+	if s.key == nil {
+		return nil, "", fmt.Errorf("encrypted with unknown key %x", id)
+	}
+
+	if err := s.next(); err != nil {
+		return nil, "", err
+	}
+	length, n := binary.Uvarint(s.buf)
+	if n <= 0 || uint64(len(s.buf)-n) < length {
+		return nil, "", fmt.Errorf("invalid name")
+	}
+	name := string(s.buf[n : n+int(length)])
+	s.buf = s.buf[n+int(length):]
+	return s, name, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next segment into buf.
+func (s *streamReader) next() error {
+	sealed := make([]byte, encryptSegmentSize+s.key.aead.Overhead())
+	n, err := io.ReadFull(s.r, sealed)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := s.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plaintext, err := s.key.aead.Open(sealed[:0], streamNonce(s.header, s.counter, last), sealed[:n], s.header)
+	if err != nil {
+		return fmt.Errorf("segment %d: %w", s.counter, err)
+	}
+	s.counter++
+	s.buf = plaintext
+	s.done = last
+	return nil
+}
+
+// unseal decrypts data, returning the name it was sealed with. Unencrypted
+// data (if allowed) is returned as is with no name.
+func (k *keyring) unseal(data []byte) (string, []byte, error) {
+	if bytes.HasPrefix(data, []byte(streamMagic)) {
+		s, name, err := k.newStreamReader(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return "", nil, err
+		}
+		plaintext, err := io.ReadAll(s)
+		return name, plaintext, err
+	}
+	if !bytes.HasPrefix(data, []byte(encryptMagic)) {
+		if k.allowPlaintext {
+			return "", data, nil
+		}
+		return "", nil, fmt.Errorf("not encrypted")
+	}
+
+	headerSize := len(encryptMagic) + keyIDSize
+	if len(data) < headerSize {
+		return "", nil, fmt.Errorf("truncated")
+	}
+	id := data[len(encryptMagic):headerSize]
+	var key *encryptionKey
+	for _, k := range k.keys {
+		if bytes.Equal(k.id, id) {
+			key = k
+		}
+	}
+	if key == nil {
+		return "", nil, fmt.Errorf("encrypted with unknown key %x", id)
+	}
+
+	nonceSize := key.aead.NonceSize()
+	if len(data) < headerSize+nonceSize {
+		return "", nil, fmt.Errorf("truncated")
+	}
+	nonce := data[headerSize : headerSize+nonceSize]
+	plaintext, err := key.aead.Open(nil, nonce, data[headerSize+nonceSize:], data[:headerSize])
+	if err != nil {
+		return "", nil, err
+	}
+
+	length, n := binary.Uvarint(plaintext)
+	if n <= 0 || uint64(len(plaintext)-n) < length {
+		return "", nil, fmt.Errorf("invalid name")
+	}
+	return string(plaintext[n : n+int(length)]), plaintext[n+int(length):], nil
+}
+
+// isCurrent reports whether data is content sealed in segments with the
+// current key.
+func (k *keyring) isCurrent(data []byte) bool {
+	return bytes.HasPrefix(data, append([]byte(streamMagic), k.current().id...))
+}
+
+// encryptStore encrypts content on its way into another BlobStore, and
+// stores it under a keyed hash of its name.
+//
+// List reports the names content is stored under, not the names it was
+// written with; use keyring.storedNames to find them.
+type encryptStore struct {
+	BlobStore
+	keys *keyring
+}
+
+func (s *encryptStore) Get(name string) ([]byte, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Open decrypts content a segment at a time as it is read. A segment that
+// fails to decrypt is reported by Read, so callers must not trust what
+// they have read until it returns io.EOF.
+func (s *encryptStore) Open(name string) (io.ReadCloser, error) {
+	for _, stored := range s.keys.storedNames(name) {
+		r, err := s.BlobStore.Open(stored)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		d, err := s.keys.openStream(name, r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return readCloser{d, r.Close}, nil
+	}
+	return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (s *encryptStore) Put(name string, data []byte) error {
+	return s.BlobStore.Put(s.keys.current().blobName(name), s.keys.sealStream(name, data))
+}
+
+func (s *encryptStore) Has(name string) (bool, error) {
+	_, err := s.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *encryptStore) Stat(name string) (BlobInfo, error) {
+	for _, stored := range s.keys.storedNames(name) {
+		info, err := s.BlobStore.Stat(stored)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		info.Name = name
+		return info, err
+	}
+	return BlobInfo{}, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (s *encryptStore) Delete(name string) error {
+	for _, stored := range s.keys.storedNames(name) {
+		if err := s.BlobStore.Delete(stored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencrypt rewrites everything that is not encrypted with the current key.
+func (s *encryptStore) reencrypt() (int, error) {
+	stored := []string{}
+	if err := s.BlobStore.List(func(info BlobInfo) error {
+		stored = append(stored, info.Name)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, old := range stored {
+		data, err := s.BlobStore.Get(old)
+		if err != nil {
+			return count, err
+		}
+		if s.keys.isCurrent(data) {
+			continue
+		}
+		name, plaintext, err := s.keys.unseal(data)
+		if err != nil {
+			return count, fmt.Errorf("decrypting %s: %w", old, err)
+		}
+		if name == "" {
+			name = old
+		}
+
+		if err := s.Put(name, plaintext); err != nil {
+			return count, err
+		}
+		if s.keys.current().blobName(name) != old {
+			if err := s.BlobStore.Delete(old); err != nil {
+				return count, err
+			}
+		}
+		count++
+	}
+	return count, nil
+}
+
+// rotateKeys re-encrypts the tree document, the journal, the pins (see
+// cache.go) and all content with the current key. The old keys can be discarded once it returns.
+func (fs *AMFS) rotateKeys() (int, error) {
+	cs, _ := fs.blobs.(*compressStore)
+	if cs == nil {
+		return 0, fmt.Errorf("encryption is not configured")
+	}
+	es, ok := cs.BlobStore.(*encryptStore)
+	if !ok {
+		return 0, fmt.Errorf("encryption is not configured")
+	}
+	count, err := es.reencrypt()
+	if err != nil {
+		return count, err
+	}
+
+	fs.cache.mu.Lock()
+	err = fs.writeLocal(pinsFile, fs.cache.pins)
+	if err == nil {
+		err = fs.writeLocal(cacheFile, fs.cache.used)
+	}
+	fs.cache.mu.Unlock()
+	if err != nil {
+		return count, err
+	}
+
+	// write the snapshot twice so that the previous generation is also
+	// encrypted with the current key.
+	for i := 0; i < 2; i++ {
+		if err := fs.compactNow(); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// newMasterKey returns a random 256 bit key.
+func newMasterKey() []byte {
+	master := make([]byte, 32)
+	if _, err := rand.Read(master); err != nil {
+		panic(err)
+	}
+	return master
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/willscott/go-nfs-client/nfs"
+)
+
+// pathError returns the error for the NFS status code (one of the nfs.NFS3Err
+// constants), annotated with the operation and file it applies to.
+// nfs.NFS3Error turns NFS3ErrNoEnt and NFS3ErrExist into fs.ErrNotExist and
+// fs.ErrExist, so os.IsNotExist and os.IsExist keep working on the result.
+func pathError(op, path string, code uint32) error {
+	return &os.PathError{Op: op, Path: path, Err: nfs.NFS3Error(code)}
+}
+
+// toNFSError converts an error from inside AMFS into one the NFS server can
+// report to the client. Errors that already carry an NFS status are passed
+// through, io/fs and syscall errors are mapped to the matching status and
+// anything else (for example a failed transaction) is reported as an I/O
+// error.
+func toNFSError(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var nfsErr *nfs.Error
+	var pathErr *os.PathError
+	if errors.As(err, &nfsErr) {
+		if errors.As(err, &pathErr) {
+			return err
+		}
+		return &os.PathError{Op: op, Path: path, Err: nfsErr}
+	}
+
+	switch {
+	// syscall.ENOTEMPTY also matches fs.ErrExist
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return pathError(op, path, nfs.NFS3ErrNotEmpty)
+	case errors.Is(err, fs.ErrNotExist):
+		return pathError(op, path, nfs.NFS3ErrNoEnt)
+	case errors.Is(err, fs.ErrExist):
+		return pathError(op, path, nfs.NFS3ErrExist)
+	case errors.Is(err, fs.ErrPermission):
+		return pathError(op, path, nfs.NFS3ErrAcces)
+	case errors.Is(err, syscall.ENOTDIR):
+		return pathError(op, path, nfs.NFS3ErrNotDir)
+	case errors.Is(err, syscall.EISDIR):
+		return pathError(op, path, nfs.NFS3ErrIsDir)
+	case errors.Is(err, fs.ErrInvalid), errors.Is(err, syscall.EINVAL):
+		return pathError(op, path, nfs.NFS3ErrInval)
+	case errors.Is(err, syscall.ENOSPC):
+		return pathError(op, path, nfs.NFS3ErrNoSpc)
+	}
+
+	return &os.PathError{Op: op, Path: path, Err: &nfs.Error{ErrorNum: nfs.NFS3ErrIO, ErrorString: err.Error()}}
+}
+
+// isNFSError reports whether err carries the given NFS status code.
+func isNFSError(err error, code uint32) bool {
+	switch code {
+	case nfs.NFS3ErrNoEnt:
+		return errors.Is(err, fs.ErrNotExist)
+	case nfs.NFS3ErrExist:
+		return errors.Is(err, fs.ErrExist)
+	}
+	var nfsErr *nfs.Error
+	return errors.As(err, &nfsErr) && nfsErr.ErrorNum == code
+}
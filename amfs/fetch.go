@@ -0,0 +1,667 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// Replicating the tree doesn't copy the content it refers to, so peers also
+// exchange content over the connection (see peers.go). Blobs and chunks are
+// requested by their hex sha256:
+//
+//	WANT <name> <name> ...\n
+//	HAVE <name> <name> ...\n
+//	NOTHAVE <name> <name> ...\n
+//	GET <name> <offset>\n
+//	DATA <name> <offset> <total> <length>\n<data>\n
+//
+// A daemon that is missing content sends WANT to every peer, and each
+// answers with the names it has (HAVE) and those it doesn't (NOTHAVE). The
+// content is then requested from the first peer that has it, one piece at a
+// time with GET, and verified against its name once it has all arrived.
+// If that peer disconnects, the pieces received so far are kept and the
+// rest is requested from another (or the same one, once it reconnects).
+// The pieces are also written to partialDir as they arrive, so a fetch
+// interrupted by a restart carries on from there too.
+//
+// Content is fetched when a file is read (see readContent), and in the
+// background by prefetch so that it can be read when no peer is connected.
+//
+// Mergeable docs are not content-addressed, and are synced with their own
+// SyncState per peer instead:
+//
+//	DOCSYNC <amid> <length>\n<sync message>\n
+//
+// A daemon sends a sync message for a doc whenever the tree records new
+// heads for it, or the peer has sent one.
+
+// peerPieceSize is how much of a blob is sent in reply to each GET.
+const peerPieceSize = 1024 * 1024
+
+// peerSendBlobs is how many blobs being sent to a peer are kept in memory
+// between its GETs.
+const peerSendBlobs = 4
+
+// partialDir holds a journal of the pieces received so far for each blob
+// being fetched, sealed if the data directory is encrypted.
+const partialDir = "partial"
+
+// peerFetchTimeout is how long a reader waits for content to arrive from
+// a peer before giving up. The fetch carries on in the background.
+const peerFetchTimeout = 30 * time.Second
+
+// fetch is a blob being fetched from peers.
+type fetch struct {
+	// data is what has been received so far, which is kept if the peer
+	// disconnects so that another can send the rest
+	data []byte
+	// partial records data in partialDir, or is nil if it can't
+	partial *journal
+	// source is the peer sending the data, or nil
+	source *peerConn
+	// asked are the peers that might have it
+	asked map[*peerConn]bool
+	// done is closed once err is set, or the content is stored
+	done chan struct{}
+	err  error
+}
+
+// validHash reports whether name is the hex sha256 of some content.
+func validHash(name string) bool {
+	h, err := hex.DecodeString(name)
+	return err == nil && len(h) == sha256.Size && hex.EncodeToString(h) == name
+}
+
+// validAMID reports whether id could have been returned by newID.
+func validAMID(id AMID) bool {
+	b, err := base64.RawURLEncoding.DecodeString(string(id))
+	return err == nil && len(b) == 32
+}
+
+// connectPeer registers a new connection to peer, and asks it for the
+// content that is still being fetched.
+func (fs *AMFS) connectPeer(peer string) *peerConn {
+	pc := &peerConn{
+		peer:    peer,
+		ready:   make(chan struct{}, 1),
+		docs:    map[AMID]*automerge.SyncState{},
+		sent:    map[AMID]string{},
+		sending: map[string][]byte{},
+		files:   fs.watchFiles(),
+	}
+
+	fs.peers.mu.Lock()
+	if fs.peers.conns == nil {
+		fs.peers.conns = map[*peerConn]bool{}
+	}
+	fs.peers.conns[pc] = true
+	want := []string{}
+	for name, f := range fs.peers.fetches {
+		if f.source == nil {
+			f.asked[pc] = true
+			want = append(want, name)
+		}
+	}
+	fs.peers.mu.Unlock()
+
+	if len(want) > 0 {
+		pc.send("WANT " + strings.Join(want, " "))
+	}
+	// wake prefetch, which waits for peers to connect
+	fs.peers.notify()
+	return pc
+}
+
+// disconnectPeer forgets pc, saving its sync states for the next connection
+// and asking the other peers for anything it was sending.
+func (fs *AMFS) disconnectPeer(pc *peerConn) {
+	fs.unwatchFiles(pc.files)
+	fs.mergeable.mu.Lock()
+	saved := map[AMID][]byte{}
+	for id, state := range pc.docs {
+		saved[id] = state.Save()
+		fs.releaseMergeable(id)
+		delete(pc.docs, id)
+	}
+	fs.mergeable.mu.Unlock()
+
+	fs.peers.mu.Lock()
+	if fs.peers.savedDocs == nil {
+		fs.peers.savedDocs = map[string]map[AMID][]byte{}
+	}
+	fs.peers.savedDocs[pc.peer] = saved
+	delete(fs.peers.conns, pc)
+	want := map[*peerConn][]string{}
+	for name, f := range fs.peers.fetches {
+		delete(f.asked, pc)
+		if f.source != pc {
+			continue
+		}
+		f.source = nil
+		for other := range fs.peers.conns {
+			f.asked[other] = true
+			want[other] = append(want[other], name)
+		}
+	}
+	fs.peers.mu.Unlock()
+
+	for other, names := range want {
+		other.send("WANT " + strings.Join(names, " "))
+	}
+}
+
+// fetchContent makes sure that the content with the given head, and each of
+// its chunks, is stored, fetching anything missing from the peers. If no
+// peers are connected it does nothing, and reading the content will fail
+// as usual.
+func (fs *AMFS) fetchContent(head []byte) error {
+	if !fs.peers.connected() {
+		return nil
+	}
+	if err := fs.fetchBlobs(hex.EncodeToString(head)); err != nil {
+		return err
+	}
+	chunks, err := fs.blobChunks(head)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, c := range chunks {
+		names = append(names, hex.EncodeToString(c.Hash))
+	}
+	return fs.fetchBlobs(names...)
+}
+
+// fetchBlobs fetches the named blobs that are not stored from the peers,
+// and waits for them to arrive.
+func (fs *AMFS) fetchBlobs(names ...string) error {
+	missing := []string{}
+	for _, name := range names {
+		has, err := fs.blobs.Has(name)
+		if err != nil {
+			return err
+		}
+		if !has {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	fetches := []*fetch{}
+	want := map[*peerConn][]string{}
+	fs.peers.mu.Lock()
+	if fs.peers.fetches == nil {
+		fs.peers.fetches = map[string]*fetch{}
+	}
+	for _, name := range missing {
+		f, ok := fs.peers.fetches[name]
+		if !ok {
+			f = &fetch{asked: map[*peerConn]bool{}, done: make(chan struct{})}
+			f.data, f.partial = fs.openPartial(name)
+			fs.peers.fetches[name] = f
+		}
+		if f.source == nil {
+			for pc := range fs.peers.conns {
+				if !f.asked[pc] {
+					f.asked[pc] = true
+					want[pc] = append(want[pc], name)
+				}
+			}
+		}
+		fetches = append(fetches, f)
+	}
+	fs.peers.mu.Unlock()
+
+	for pc, names := range want {
+		pc.send("WANT " + strings.Join(names, " "))
+	}
+
+	for i, f := range fetches {
+		select {
+		case <-f.done:
+			if f.err != nil {
+				return f.err
+			}
+		case <-time.After(peerFetchTimeout):
+			return fmt.Errorf("fetch %s: timed out", missing[i])
+		}
+	}
+	return nil
+}
+
+// finishFetch ends the fetch of name.
+// The caller must hold fs.peers.mu.
+func (fs *AMFS) finishFetch(name string, f *fetch, err error) {
+	if fs.peers.fetches[name] == f {
+		delete(fs.peers.fetches, name)
+	}
+	if f.partial != nil {
+		// after any piece that is being recorded
+		f.partial.mu.Lock()
+		f.partial.f.Close()
+		f.partial.mu.Unlock()
+		os.Remove(f.partial.path)
+		f.partial = nil
+	}
+	f.err = err
+	close(f.done)
+}
+
+// openPartial returns the pieces of name received before the daemon last
+// stopped, and the journal to record the rest in.
+func (fs *AMFS) openPartial(name string) ([]byte, *journal) {
+	path := filepath.Join(fs.path(partialDir), name)
+	if err := os.MkdirAll(fs.path(partialDir), 0o755); err != nil {
+		fmt.Println("ERROR: fetch", name+":", err)
+		return nil, nil
+	}
+	j, records, err := openJournal(path)
+	if err != nil {
+		fmt.Println("ERROR: fetch", name+":", err)
+		return nil, nil
+	}
+	data := []byte{}
+	for _, record := range records {
+		piece, err := fs.keys.open(name, record)
+		if err != nil {
+			fmt.Println("ERROR: fetch", name+": starting again:", err)
+			j.f.Close()
+			os.Remove(path)
+			if j, _, err = openJournal(path); err != nil {
+				fmt.Println("ERROR: fetch", name+":", err)
+				return nil, nil
+			}
+			return nil, j
+		}
+		data = append(data, piece...)
+	}
+	if len(data) > 0 {
+		fmt.Println("fetch", name+": resuming after", len(data), "bytes")
+	}
+	return data, j
+}
+
+// receiveWant tells the peer which of the named blobs are stored.
+func (fs *AMFS) receiveWant(pc *peerConn, names []string) {
+	have := []string{}
+	notHave := []string{}
+	for _, name := range names {
+		ok := false
+		if validHash(name) {
+			ok, _ = fs.blobs.Has(name)
+		}
+		if ok {
+			have = append(have, name)
+		} else {
+			notHave = append(notHave, name)
+		}
+	}
+	if len(have) > 0 {
+		pc.send("HAVE " + strings.Join(have, " "))
+	}
+	if len(notHave) > 0 {
+		pc.send("NOTHAVE " + strings.Join(notHave, " "))
+	}
+}
+
+// receiveHave starts fetching the named blobs from the peer, unless another
+// peer is already sending them.
+func (fs *AMFS) receiveHave(pc *peerConn, names []string) {
+	gets := []string{}
+	fs.peers.mu.Lock()
+	for _, name := range names {
+		f, ok := fs.peers.fetches[name]
+		if ok && f.source == nil {
+			f.source = pc
+			gets = append(gets, fmt.Sprintf("GET %s %d", name, len(f.data)))
+		}
+	}
+	fs.peers.mu.Unlock()
+
+	for _, get := range gets {
+		pc.send(get)
+	}
+}
+
+// receiveNotHave gives up on fetching the named blobs from the peer. A
+// fetch fails once none of the peers have the blob.
+func (fs *AMFS) receiveNotHave(pc *peerConn, names []string) {
+	want := map[*peerConn][]string{}
+	fs.peers.mu.Lock()
+	for _, name := range names {
+		f, ok := fs.peers.fetches[name]
+		if !ok {
+			continue
+		}
+		delete(f.asked, pc)
+		if f.source == pc {
+			// the peer had it, but doesn't any more, so ask the others again
+			f.source = nil
+			for other := range f.asked {
+				want[other] = append(want[other], name)
+			}
+		}
+		if f.source == nil && len(f.asked) == 0 {
+			fs.finishFetch(name, f, fmt.Errorf("fetch %s: %w", name, os.ErrNotExist))
+		}
+	}
+	fs.peers.mu.Unlock()
+
+	for other, names := range want {
+		other.send("WANT " + strings.Join(names, " "))
+	}
+}
+
+// receiveGet sends the peer the piece of the named blob that starts at
+// offset.
+func (fs *AMFS) receiveGet(pc *peerConn, name string, offset string) {
+	at, err := strconv.Atoi(offset)
+	if !validHash(name) || err != nil || at < 0 {
+		pc.send("NOTHAVE " + name)
+		return
+	}
+	// the blob is kept until the last piece is sent, rather than read
+	// again for each one
+	data, ok := pc.sending[name]
+	if !ok {
+		if data, err = fs.blobs.Get(name); err != nil {
+			pc.send("NOTHAVE " + name)
+			return
+		}
+		if len(pc.sending) >= peerSendBlobs {
+			for other := range pc.sending {
+				delete(pc.sending, other)
+				break
+			}
+		}
+		pc.sending[name] = data
+	}
+	if at > len(data) {
+		pc.send("NOTHAVE " + name)
+		return
+	}
+	end := at + peerPieceSize
+	if end >= len(data) {
+		end = len(data)
+		delete(pc.sending, name)
+	}
+	piece := data[at:end]
+	pc.sendPayload(fmt.Sprintf("DATA %s %d %d %d", name, at, len(data), len(piece)), piece)
+}
+
+// receiveData adds a piece of a blob from the peer to its fetch, and
+// stores the blob once it is complete and verified.
+func (fs *AMFS) receiveData(pc *peerConn, name string, offset, total int64, piece []byte) {
+	fs.peers.mu.Lock()
+	f, ok := fs.peers.fetches[name]
+	if !ok || f.source != pc || offset != int64(len(f.data)) {
+		// a piece we asked for before the fetch was finished or moved
+		fs.peers.mu.Unlock()
+		return
+	}
+	f.data = append(f.data, piece...)
+	data := f.data
+	// the piece is recorded after unlocking, as that waits for it to reach
+	// the disk; the journal stays locked until then to keep pieces in order
+	partial := f.partial
+	if partial != nil && len(piece) > 0 {
+		partial.mu.Lock()
+	} else {
+		partial = nil
+	}
+	fs.peers.mu.Unlock()
+
+	if partial != nil {
+		err := partial.append(fs.keys.seal(name, piece))
+		partial.mu.Unlock()
+		if err != nil {
+			fs.peers.mu.Lock()
+			// unless the fetch has finished, and closed it, meanwhile
+			if f.partial == partial {
+				fmt.Println("ERROR: fetch", name+": not keeping what was received:", err)
+				partial.f.Close()
+				f.partial = nil
+			}
+			fs.peers.mu.Unlock()
+		}
+	}
+	if int64(len(data)) < total && len(piece) > 0 {
+		pc.send(fmt.Sprintf("GET %s %d", name, len(data)))
+		return
+	}
+
+	h := sha256.Sum256(data)
+	var err error
+	if hex.EncodeToString(h[:]) != name || int64(len(data)) != total {
+		err = fmt.Errorf("fetch %s: peer %s sent content that hashes to %s", name, pc.peer, hex.EncodeToString(h[:]))
+	} else if err = fs.writeBlob(h[:], data); err == nil {
+		fs.fetched(name)
+	}
+	if err != nil {
+		fmt.Println("ERROR:", err)
+	}
+
+	fs.peers.mu.Lock()
+	fs.finishFetch(name, f, err)
+	fs.peers.mu.Unlock()
+}
+
+// prefetch fetches the content of every file (or with a content budget,
+// every pinned file) from the peers as the tree changes, so that it can be
+// read when they are not connected. Only the files that have changed (or
+// been pinned) since the last time are looked at, along with any whose
+// content couldn't be fetched then.
+func (fs *AMFS) prefetch(ctx context.Context) {
+	w := fs.watchFiles()
+	defer fs.unwatchFiles(w)
+	// stored are the heads known to be stored along with their chunks
+	stored := map[string]bool{}
+	retry := map[AMID]bool{}
+	var wasPinned map[AMID]bool
+	for {
+		changed := fs.peers.wait()
+		if fs.peers.connected() {
+			heads := map[AMID][][]byte{}
+			err := fs.view(func() error {
+				t, files, err := fs.changedFiles(w)
+				if err != nil {
+					return err
+				}
+				for amid := range retry {
+					files[amid] = true
+				}
+				var pinned map[AMID]bool
+				if fs.lazy() {
+					if pinned, err = fs.pinned(); err != nil {
+						return err
+					}
+					for amid := range pinned {
+						if !wasPinned[amid] {
+							files[amid] = true
+						}
+					}
+					wasPinned = pinned
+				}
+				for amid := range files {
+					if pinned != nil && !pinned[amid] {
+						continue
+					}
+					if f := t.files[amid]; f != nil && f.Type == Blob {
+						heads[amid] = f.Heads
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Println("ERROR: prefetch:", err)
+			}
+			retry = map[AMID]bool{}
+			for amid, heads := range heads {
+				for _, head := range heads {
+					name := hex.EncodeToString(head)
+					if stored[name] {
+						continue
+					}
+					if err := fs.fetchContent(head); err != nil {
+						fmt.Println("prefetch", name, err)
+					}
+					if has, _ := fs.blobs.Has(name); has {
+						stored[name] = true
+					} else {
+						retry[amid] = true
+					}
+				}
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchDoc waits for the mergeable doc to have the given heads, if it is
+// missing them and a peer is connected that might send them.
+func (fs *AMFS) fetchDoc(id AMID, heads [][]byte) error {
+	timeout := time.After(peerFetchTimeout)
+	for {
+		changed := fs.peers.wait()
+		fs.mergeable.mu.Lock()
+		doc, err := fs.mergeableDoc(id)
+		missing := false
+		for _, h := range heads {
+			var hash automerge.ChangeHash
+			copy(hash[:], h)
+			if err == nil {
+				if _, e := doc.Change(hash); e != nil {
+					missing = true
+				}
+			}
+		}
+		fs.mergeable.mu.Unlock()
+		if err != nil || !missing || !fs.peers.connected() {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return fmt.Errorf("fetch %s: timed out", id)
+		}
+	}
+}
+
+// docState returns the sync state of the mergeable doc for the peer,
+// resuming from where the last connection to it left off.
+// The caller must hold fs.mergeable.mu.
+func (fs *AMFS) docState(pc *peerConn, id AMID) (*automerge.SyncState, error) {
+	if state, ok := pc.docs[id]; ok {
+		return state, nil
+	}
+	doc, err := fs.mergeableDoc(id)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.peers.mu.Lock()
+	saved, ok := fs.peers.savedDocs[pc.peer][id]
+	fs.peers.mu.Unlock()
+
+	state := automerge.NewSyncState(doc)
+	if ok {
+		if state, err = automerge.LoadSyncState(doc, saved); err != nil {
+			return nil, err
+		}
+	}
+	fs.useMergeable(id, doc)
+	pc.docs[id] = state
+	return state, nil
+}
+
+// syncDocs sends the peer a sync message for each mergeable doc that the
+// tree has recorded new heads for since the last one.
+func (fs *AMFS) syncDocs(pc *peerConn) error {
+	heads := map[AMID]string{}
+	err := fs.view(func() error {
+		t, files, err := fs.changedFiles(pc.files)
+		if err != nil {
+			return err
+		}
+		for amid := range files {
+			if f := t.files[amid]; f != nil && f.Type == Mergeable {
+				heads[amid] = fmt.Sprintf("%x", f.Heads)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.mergeable.mu.Lock()
+	defer fs.mergeable.mu.Unlock()
+	for _, id := range sortedAMIDs(heads) {
+		if pc.sent[id] == heads[id] {
+			continue
+		}
+		pc.sent[id] = heads[id]
+		state, err := fs.docState(pc, id)
+		if err != nil {
+			return err
+		}
+		if msg, valid := state.GenerateMessage(); valid {
+			pc.sendPayload(fmt.Sprintf("DOCSYNC %s %d", id, len(msg)), msg)
+		}
+	}
+	return nil
+}
+
+// receiveDoc applies a sync message from the peer to the mergeable doc,
+// and replies.
+func (fs *AMFS) receiveDoc(pc *peerConn, id AMID, msg []byte) error {
+	if !validAMID(id) {
+		return fmt.Errorf("invalid doc: %#v", id)
+	}
+
+	fs.mergeable.mu.Lock()
+	state, err := fs.docState(pc, id)
+	if err != nil {
+		fs.mergeable.mu.Unlock()
+		return err
+	}
+	before := fmt.Sprint(state.Doc.Heads())
+	if err := state.ReceiveMessage(msg); err != nil {
+		fs.mergeable.mu.Unlock()
+		return err
+	}
+	changed := fmt.Sprint(state.Doc.Heads()) != before
+	if changed {
+		err = fs.blobs.Put(string(id), state.Doc.Save())
+	}
+	if err == nil {
+		if reply, valid := state.GenerateMessage(); valid {
+			pc.sendPayload(fmt.Sprintf("DOCSYNC %s %d", id, len(reply)), reply)
+		}
+	}
+	fs.mergeable.mu.Unlock()
+
+	if changed {
+		// wake anything waiting for the doc in fetchDoc
+		fs.peers.notify()
+	}
+	return err
+}
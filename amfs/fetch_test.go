@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testBlob(t *testing.T, size int) (string, []byte) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), data
+}
+
+func TestReceiveGet(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	name, data := testBlob(t, 2*peerPieceSize+10)
+	if err := fs.blobs.Put(name, data); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := &peerConn{peer: "test", ready: make(chan struct{}, 1), sending: map[string][]byte{}}
+	fs.receiveGet(pc, name, "0")
+	// the rest is sent from memory
+	if err := fs.blobs.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	fs.receiveGet(pc, name, fmt.Sprint(peerPieceSize))
+	fs.receiveGet(pc, name, fmt.Sprint(2*peerPieceSize))
+	if len(pc.sending) != 0 {
+		t.Fatal("blob still held after the last piece")
+	}
+
+	got := []byte{}
+	for i, msg := range pc.queue {
+		line, payload, _ := bytes.Cut(msg, []byte("\n"))
+		want := fmt.Sprintf("DATA %s %d %d ", name, i*peerPieceSize, len(data))
+		if !strings.HasPrefix(string(line), want) {
+			t.Fatalf("sent %q", line)
+		}
+		got = append(got, bytes.TrimSuffix(payload, []byte("\n"))...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("sent %d bytes of %d", len(got), len(data))
+	}
+}
+
+func TestFetchResumes(t *testing.T) {
+	c := testConfig(t)
+	name, data := testBlob(t, 2*peerPieceSize)
+
+	// the first piece arrives, and then the daemon stops
+	fs := openTestFS(t, c)
+	pc := &peerConn{peer: "test", ready: make(chan struct{}, 1)}
+	f := &fetch{source: pc, asked: map[*peerConn]bool{}, done: make(chan struct{})}
+	f.data, f.partial = fs.openPartial(name)
+	fs.peers.fetches = map[string]*fetch{name: f}
+	fs.receiveData(pc, name, 0, int64(len(data)), data[:peerPieceSize])
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = openTestFS(t, c)
+	defer fs.Close()
+	f = &fetch{source: pc, asked: map[*peerConn]bool{}, done: make(chan struct{})}
+	f.data, f.partial = fs.openPartial(name)
+	if !bytes.Equal(f.data, data[:peerPieceSize]) {
+		t.Fatalf("resumed with %d bytes", len(f.data))
+	}
+	fs.peers.fetches = map[string]*fetch{name: f}
+	fs.receiveData(pc, name, peerPieceSize, int64(len(data)), data[peerPieceSize:])
+	<-f.done
+	if f.err != nil {
+		t.Fatal(f.err)
+	}
+	stored, err := fs.blobs.Get(name)
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("stored %d bytes: %v", len(stored), err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.path(partialDir), name)); !os.IsNotExist(err) {
+		t.Fatalf("pieces kept after the fetch: %v", err)
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// lostAndFound is the folder in ROOT that fsck --repair moves orphaned
+// files into.
+const lostAndFound = "lost+found"
+
+// fsckProblem is an invariant that does not hold.
+type fsckProblem struct {
+	Kind   string
+	AMID   AMID
+	Path   string
+	Detail string
+
+	// the entry the problem was found in, if any
+	parent AMID
+	name   string
+
+	// repair adds the operations that fix the problem to tx, or is nil if
+	// fsck can't fix it.
+	repair func(tx *atx) *atx
+}
+
+func (p *fsckProblem) String() string {
+	where := string(p.AMID)
+	if p.Path != "" {
+		where = p.Path + " (" + where + ")"
+	}
+	return p.Kind + " " + where + ": " + p.Detail
+}
+
+// fsckReport describes the result of checking the filesystem.
+type fsckReport struct {
+	Files    int
+	Folders  int
+	Deleted  int
+	Problems []*fsckProblem
+	Repair   bool
+	Repaired int
+}
+
+func (r *fsckReport) String() string {
+	return fmt.Sprintf("%d files, %d folders, %d deleted: %d problems, %d repaired",
+		r.Files, r.Folders, r.Deleted, len(r.Problems), r.Repaired)
+}
+
+// unresolved returns the number of problems that are still there.
+func (r *fsckReport) unresolved() int {
+	if !r.Repair {
+		return len(r.Problems)
+	}
+	n := 0
+	for _, p := range r.Problems {
+		if p.repair == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// fsck checks the invariants of the tree document and the content it
+// refers to. It takes the same locks as normal operations, so it can run
+// while the filesystem is in use.
+//
+// If repair is set, the problems that can be fixed in the tree are: folder
+// entries are made to agree with the locations of files, dangling entries
+// and entries that form a cycle are dropped, files and folders that have
+// become unreachable from ROOT are moved into /lost+found, and permissions
+// are made to match the type.
+// Missing or damaged content can't be repaired.
+//
+// With a content budget, content that isn't stored is only reported for
+// pinned files, as the rest is fetched from peers when it is read.
+func (fs *AMFS) fsck(repair bool) (*fsckReport, error) {
+	var st *fsckState
+	var pinned map[AMID]bool
+	err := fs.view(func() error {
+		var err error
+		if st, err = loadFsckState(fs.doc); err != nil {
+			return err
+		}
+		if fs.lazy() {
+			pinned, err = fs.pinned()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	st.checkTree()
+	fs.checkContent(st, pinned)
+
+	report := &fsckReport{Files: len(st.files), Deleted: len(st.deleted), Problems: st.problems, Repair: repair}
+	for _, f := range st.files {
+		if f.Type == Folder {
+			report.Folders++
+		}
+	}
+	if !repair {
+		return report, nil
+	}
+
+	// Each pass can uncover more to do (e.g. an orphaned cycle becomes an
+	// ordinary cycle once it is moved into lost+found), so repeat until
+	// there is nothing left that can be fixed.
+	for i := 0; i < 10; i++ {
+		n, err := fs.repairTree()
+		report.Repaired += n
+		if err != nil || n == 0 {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// repairTree fixes the problems found by checkTree that can be repaired,
+// returning how many there were.
+func (fs *AMFS) repairTree() (int, error) {
+	n := 0
+	err := fs.update(func() error {
+		st, err := loadFsckState(fs.doc)
+		if err != nil {
+			return err
+		}
+		st.checkTree()
+
+		tx := fs.Tx()
+		for _, p := range st.problems {
+			if p.repair != nil {
+				fmt.Println("fsck: repairing", p)
+				tx = p.repair(tx)
+				n++
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		return tx.Describe("fsck: repair %d problems", n).Commit()
+	})
+	return n, err
+}
+
+// fsckState is a snapshot of the tree document being checked.
+type fsckState struct {
+	files   map[AMID]*AMFile
+	folders map[AMID]map[string]AMID
+	tree    *tree
+
+	// paths of everything reachable from ROOT
+	paths map[AMID]string
+	// files that were removed (they are unreachable, and so is every
+	// folder that refers to them)
+	deleted map[AMID]bool
+
+	problems  []*fsckProblem
+	lostFound AMID
+}
+
+func loadFsckState(doc *automerge.Doc) (*fsckState, error) {
+	files, err := automerge.As[map[AMID]*AMFile](doc.Path("files").Get())
+	if err != nil {
+		return nil, err
+	}
+	folders, err := automerge.As[map[AMID]map[string]AMID](doc.Path("folders").Get())
+	if err != nil {
+		return nil, err
+	}
+	for amid, f := range files {
+		if f == nil {
+			delete(files, amid)
+		}
+	}
+	t, err := resolveTree(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &fsckState{files: files, folders: folders, tree: t, paths: map[AMID]string{}, deleted: map[AMID]bool{}}, nil
+}
+
+func (st *fsckState) report(p *fsckProblem) {
+	st.problems = append(st.problems, p)
+}
+
+// isFolder reports whether lookups descend into amid.
+func (st *fsckState) isFolder(amid AMID) bool {
+	return st.files[amid] != nil && st.files[amid].Type == Folder
+}
+
+// sortedEntries returns the entries of a folder in name order, so that
+// repairs are deterministic.
+func (st *fsckState) sortedEntries(folder AMID) []string {
+	return sortedNames(st.folders[folder])
+}
+
+func sortedAMIDs[T any](m map[AMID]T) []AMID {
+	ids := []AMID{}
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// checkTree checks the structure of the tree document.
+func (st *fsckState) checkTree() {
+	if !st.isFolder(ROOT) {
+		st.report(&fsckProblem{Kind: "root", AMID: ROOT, Path: "/", Detail: "ROOT is missing or not a folder"})
+		return
+	}
+
+	st.checkTypes()
+	st.checkEntries()
+	st.checkIndex()
+	st.walk(ROOT, "", map[AMID]bool{})
+	st.checkUnreachable()
+
+	for _, p := range st.problems {
+		if p.Path != "" {
+			continue
+		}
+		if p.parent != "" {
+			if parent, ok := st.paths[p.parent]; ok {
+				p.Path = parent + "/" + p.name
+			}
+		} else {
+			p.Path = st.paths[p.AMID]
+		}
+	}
+}
+
+// checkTypes checks that Type and Permissions agree, and that exactly the
+// folders have a folders map.
+func (st *fsckState) checkTypes() {
+	for _, amid := range sortedAMIDs(st.files) {
+		amid, f := amid, st.files[amid]
+		_, hasMap := st.folders[amid]
+
+		switch f.Type {
+		case Folder, Blob, Mergeable:
+		default:
+			typ := Blob
+			if hasMap {
+				typ = Folder
+			}
+			st.report(&fsckProblem{Kind: "type", AMID: amid, Detail: fmt.Sprintf("unknown type %d", f.Type),
+				repair: func(tx *atx) *atx {
+					return tx.Set("files", amid, "type").To(typ)
+				}})
+			f.Type = typ
+		}
+
+		if (f.Type == Folder) != f.Permissions.IsDir() {
+			perm := f.Permissions &^ os.ModeDir
+			if f.Type == Folder {
+				perm |= os.ModeDir
+			}
+			st.report(&fsckProblem{Kind: "mode", AMID: amid,
+				Detail: fmt.Sprintf("permissions %s do not match type %d", f.Permissions, f.Type),
+				repair: func(tx *atx) *atx {
+					return tx.Set("files", amid, "perm").To(perm)
+				}})
+		}
+
+		if f.Type == Folder && !hasMap {
+			st.report(&fsckProblem{Kind: "folder", AMID: amid, Detail: "folder has no entries map",
+				repair: func(tx *atx) *atx {
+					return tx.Set("folders", amid).To(automerge.NewMap())
+				}})
+		}
+	}
+}
+
+// checkEntries finds folder entries that refer to files that don't exist,
+// and entries maps for things that aren't folders.
+func (st *fsckState) checkEntries() {
+	for _, parent := range sortedAMIDs(st.folders) {
+		parent := parent
+		if !st.isFolder(parent) {
+			detail := "entries map for a file that doesn't exist"
+			if st.files[parent] != nil {
+				detail = "entries map for a file that isn't a folder"
+			}
+			// anything only reachable through here is moved to lost+found
+			// by checkUnreachable before the map is dropped
+			st.report(&fsckProblem{Kind: "stray", AMID: parent, Detail: detail,
+				repair: func(tx *atx) *atx {
+					return tx.Del("folders", parent)
+				}})
+		}
+
+		for _, name := range st.sortedEntries(parent) {
+			name, child := name, st.folders[parent][name]
+			if st.files[child] != nil {
+				continue
+			}
+			p := &fsckProblem{Kind: "dangling", AMID: child, parent: parent, name: name,
+				Detail: "entry refers to a file that doesn't exist"}
+			// in a stray map, the entry goes with the map
+			if st.isFolder(parent) {
+				p.repair = func(tx *atx) *atx {
+					return tx.Del("folders", parent, name).Inc("files", parent, "modcount")
+				}
+			}
+			st.report(p)
+			delete(st.folders[parent], name)
+		}
+	}
+}
+
+// checkIndex checks that the folders maps agree with where files are, as
+// resolved from their locations (see tree.go). Lookups only follow entries
+// that agree, so the others are harmless, but the index should be repaired
+// to match.
+//
+// The rest of the checks look at the folders as they will be once the index
+// has been repaired.
+func (st *fsckState) checkIndex() {
+	for _, parent := range sortedAMIDs(st.folders) {
+		if !st.isFolder(parent) {
+			continue
+		}
+		for _, name := range st.sortedEntries(parent) {
+			parent, name, child := parent, name, st.folders[parent][name]
+			if _, ok := st.tree.parent[child]; !ok || st.tree.lookup(parent, name) == child {
+				continue
+			}
+			detail := "entry disagrees with the location of the file"
+			if p := st.tree.parent[child]; p == trashRoot {
+				detail = "entry refers to a file in the trash"
+			}
+			st.report(&fsckProblem{Kind: "stale", AMID: child, parent: parent, name: name, Detail: detail,
+				repair: func(tx *atx) *atx {
+					return tx.Del("folders", parent, name).Inc("files", parent, "modcount")
+				}})
+		}
+	}
+
+	resolved := map[AMID]map[string]AMID{}
+	for _, parent := range sortedAMIDs(st.tree.children) {
+		if !st.isFolder(parent) {
+			continue
+		}
+		resolved[parent] = map[string]AMID{}
+		for name, child := range st.tree.children[parent] {
+			resolved[parent][name] = child
+		}
+		for _, name := range sortedNames(resolved[parent]) {
+			parent, name, child := parent, name, resolved[parent][name]
+			// conflict copies are only named in the tree
+			if _, ok := st.tree.conflicts[child]; ok || st.folders[parent][name] == child {
+				continue
+			}
+			st.report(&fsckProblem{Kind: "unindexed", AMID: child, parent: parent, name: name,
+				Detail: "file is missing from its folder's entries",
+				repair: func(tx *atx) *atx {
+					return tx.Set("folders", parent, name).To(child).Inc("files", parent, "modcount")
+				}})
+		}
+	}
+	// folders with nothing in them, and stray maps, as they were
+	for amid, entries := range st.folders {
+		if _, ok := resolved[amid]; !ok && (len(entries) == 0 || !st.isFolder(amid)) {
+			resolved[amid] = entries
+		}
+	}
+	st.folders = resolved
+}
+
+func sortedNames(entries map[string]AMID) []string {
+	names := []string{}
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// walk records the path of everything reachable from folder, and reports
+// entries that point back up the tree.
+func (st *fsckState) walk(folder AMID, path string, stack map[AMID]bool) {
+	st.paths[folder] = path
+	stack[folder] = true
+	defer delete(stack, folder)
+
+	for _, name := range st.sortedEntries(folder) {
+		name, child := name, st.folders[folder][name]
+		childPath := path + "/" + name
+
+		if stack[child] {
+			st.report(&fsckProblem{Kind: "cycle", AMID: child, parent: folder, name: name,
+				Detail: "entry refers to a folder that contains it (" + st.paths[child] + ")",
+				repair: func(tx *atx) *atx {
+					return tx.Del("folders", folder, name).Inc("files", folder, "modcount")
+				}})
+			continue
+		}
+		if _, seen := st.paths[child]; seen {
+			st.report(&fsckProblem{Kind: "linked", AMID: child, parent: folder, name: name,
+				Detail: "also reachable as " + st.paths[child]})
+			continue
+		}
+		if st.isFolder(child) {
+			st.walk(child, childPath, stack)
+		} else {
+			st.paths[child] = childPath
+		}
+	}
+
+	// files that lost their name to another file are still in the folder
+	for _, name := range sortedNames(st.folders[folder]) {
+		for _, child := range st.tree.others[folder][name] {
+			if _, seen := st.paths[child]; seen || stack[child] {
+				continue
+			}
+			if st.isFolder(child) {
+				st.walk(child, path+"/"+name, stack)
+			} else {
+				st.paths[child] = path + "/" + name
+			}
+		}
+	}
+}
+
+// reach marks everything reachable from amid (that isn't already marked).
+func (st *fsckState) reach(amid AMID, marked map[AMID]bool) {
+	if marked[amid] {
+		return
+	}
+	marked[amid] = true
+	if !st.isFolder(amid) {
+		return
+	}
+	for _, name := range st.sortedEntries(amid) {
+		st.reach(st.folders[amid][name], marked)
+	}
+}
+
+// checkUnreachable finds files that can't be reached from ROOT.
+//
+// Files in the trash, and everything in them, are unreachable. So are
+// files removed before there was a trash: they have no location and no
+// entries pointing to them. Anything else that is unreachable has been
+// orphaned (for example, by its folder going missing) and is moved into
+// lost+found.
+func (st *fsckState) checkUnreachable() {
+	referenced := map[AMID]bool{}
+	for parent, entries := range st.folders {
+		for _, child := range entries {
+			if child != parent {
+				referenced[child] = true
+			}
+		}
+	}
+
+	for _, amid := range sortedAMIDs(st.files) {
+		if _, ok := st.paths[amid]; ok || amid == ROOT {
+			continue
+		}
+		if st.tree.parent[amid] == trashRoot || st.files[amid].Location == nil && !referenced[amid] {
+			st.reach(amid, st.deleted)
+		}
+	}
+
+	orphans := map[AMID]bool{}
+	for amid := range st.files {
+		if _, ok := st.paths[amid]; !ok && !st.deleted[amid] {
+			orphans[amid] = true
+		}
+	}
+
+	// move the top of each orphaned tree, its contents come with it
+	inner := map[AMID]bool{}
+	for parent := range orphans {
+		if st.isFolder(parent) {
+			for _, child := range st.folders[parent] {
+				if child != parent {
+					inner[child] = true
+				}
+			}
+		}
+	}
+	covered := map[AMID]bool{}
+	adopt := func(amid AMID) {
+		st.report(&fsckProblem{Kind: "unreachable", AMID: amid, Path: "/" + lostAndFound + "/" + string(amid),
+			Detail: "not reachable from ROOT",
+			repair: func(tx *atx) *atx {
+				lf := st.lostAndFound(tx)
+				return tx.
+					Set("files", amid, "loc").To(&AMLocation{Parent: lf, Name: string(amid), MovedAt: time.Now()}).
+					Set("folders", lf, string(amid)).To(amid).
+					Inc("files", lf, "modcount")
+			}})
+		st.reach(amid, covered)
+	}
+	for _, amid := range sortedAMIDs(orphans) {
+		if !inner[amid] {
+			adopt(amid)
+		}
+	}
+	// whatever is left is in a cycle of orphans
+	for _, amid := range sortedAMIDs(orphans) {
+		if !covered[amid] {
+			adopt(amid)
+		}
+	}
+}
+
+// lostAndFound returns the AMID of /lost+found, creating it in tx if
+// necessary.
+func (st *fsckState) lostAndFound(tx *atx) AMID {
+	if st.lostFound != "" {
+		return st.lostFound
+	}
+	if id := st.folders[ROOT][lostAndFound]; id != "" && st.isFolder(id) {
+		st.lostFound = id
+		return id
+	}
+
+	st.lostFound = newID()
+	tx.Set("files", st.lostFound).To(&AMFile{
+		Permissions: 0o700 | os.ModeDir,
+		Type:        Folder,
+		ModTime:     time.Now(),
+		Location:    &AMLocation{Parent: ROOT, Name: lostAndFound, MovedAt: time.Now()},
+	}).
+		Inc("files", st.lostFound, "modcount").
+		Set("folders", st.lostFound).To(automerge.NewMap()).
+		Set("folders", ROOT, lostAndFound).To(st.lostFound).
+		Inc("files", ROOT, "modcount")
+	return st.lostFound
+}
+
+// checkContent checks that the content of every file is stored and intact.
+// If pinned is set, content that isn't stored is only reported for the
+// files in it.
+// It runs outside the lock, as it reads everything in the blob store.
+func (fs *AMFS) checkContent(st *fsckState, pinned map[AMID]bool) {
+	for _, amid := range sortedAMIDs(st.files) {
+		f := st.files[amid]
+		var err error
+		switch f.Type {
+		case Blob:
+			// including the content of concurrent versions
+			for _, head := range f.Heads {
+				if err = fs.verifyContent(head); err != nil {
+					break
+				}
+			}
+		case Mergeable:
+			var saved []byte
+			if saved, err = fs.blobs.Get(string(amid)); err == nil {
+				_, err = automerge.Load(saved)
+			}
+		default:
+			continue
+		}
+
+		if errors.Is(err, os.ErrNotExist) && pinned != nil && !pinned[amid] {
+			continue
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			st.report(&fsckProblem{Kind: "missing", AMID: amid, Path: st.paths[amid], Detail: "content is not stored"})
+		} else if err != nil {
+			st.report(&fsckProblem{Kind: "corrupt", AMID: amid, Path: st.paths[amid], Detail: err.Error()})
+		}
+	}
+}
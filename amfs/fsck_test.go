@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// problemKinds returns the kind of each problem by the AMID it is about.
+func problemKinds(r *fsckReport) map[AMID]string {
+	kinds := map[AMID]string{}
+	for _, p := range r.Problems {
+		kinds[p.AMID] = p.Kind
+	}
+	return kinds
+}
+
+func TestFsck(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	if err := fs.MkdirAll("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, fs, "d/a.txt", "a")
+	writeTestFile(t, fs, "b.txt", "b")
+	d, err := fs.getFileInfo("d", None, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.getFileInfo("b.txt", None, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := fs.fsck(false); err != nil || len(r.Problems) != 0 {
+		t.Fatalf("fsck of a new tree: %v, %v", r.Problems, err)
+	}
+
+	// a dangling entry, d orphaned by its folder going missing, and the
+	// content of b.txt lost
+	err = fs.update(func() error {
+		return fs.Tx().
+			Set("folders", ROOT, "ghost").To("nothing").
+			Set("files", d.amid, "loc").To(&AMLocation{Parent: "gone", Name: "d", MovedAt: testMoveTime}).
+			Del("folders", ROOT, "d").
+			Commit()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.blobs.Delete(hex.EncodeToString(b.file.Heads[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := problemKinds(r)
+	if kinds["nothing"] != "dangling" || kinds[d.amid] != "unreachable" || kinds[b.amid] != "missing" || len(kinds) != 3 {
+		t.Fatalf("found %v", r.Problems)
+	}
+	if r.Repaired != 0 {
+		t.Fatalf("repaired %d without --repair", r.Repaired)
+	}
+	if _, err := fs.Stat("ghost"); err == nil {
+		t.Fatal("dangling entry is visible")
+	}
+
+	r, err = fs.fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Repaired != 2 || r.unresolved() != 1 {
+		t.Fatalf("repaired %d, leaving %d", r.Repaired, r.unresolved())
+	}
+	if got := readTestFile(t, fs, lostAndFound+"/"+string(d.amid)+"/a.txt"); got != "a" {
+		t.Fatalf("a.txt in lost+found = %q", got)
+	}
+	r, err = fs.fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// missing content can't be repaired
+	if kinds := problemKinds(r); kinds[b.amid] != "missing" || len(kinds) != 1 {
+		t.Fatalf("after repair found %v", r.Problems)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// defaultGCGracePeriod protects blobs that have been written but whose
+// commit to the tree has not happened yet.
+const defaultGCGracePeriod = time.Hour
+
+// gcStats describes the result of a garbage collection.
+type gcStats struct {
+	Purged       int
+	Live         int
+	Kept         int
+	Removed      int
+	RemovedBytes int64
+}
+
+func (s *gcStats) String() string {
+	return fmt.Sprintf("%d purged from trash, %d live, %d kept within grace period, %d removed (%d bytes)",
+		s.Purged, s.Live, s.Kept, s.Removed, s.RemovedBytes)
+}
+
+// gcLoop collects garbage every cfg.GCInterval until ctx is done.
+func (fs *AMFS) gcLoop(ctx context.Context) {
+	if fs.cfg.GCInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(fs.cfg.GCInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			stats, err := fs.collectGarbage(false)
+			if err != nil {
+				fmt.Println("ERROR: gc:", err)
+				continue
+			}
+			fmt.Println("gc:", stats)
+		}
+	}
+}
+
+// collectGarbage deletes stored content that is no longer referenced.
+//
+// Content is live if it is referenced by the current tree, or by the tree
+// as it was cfg.HistoryRetention ago. Anything written more recently than
+// the grace period (or the retention period, if longer) is also kept; this
+// covers both content whose commit is still in flight and every version of
+// a file saved within the retention period. Pieces of fetches from peers
+// (see partialDir) are removed by the same rule.
+//
+// Before that, files that have been in the trash for longer than
+// cfg.TrashRetention are purged.
+//
+// If dryRun is set, nothing is deleted.
+func (fs *AMFS) collectGarbage(dryRun bool) (*gcStats, error) {
+	stats := &gcStats{}
+	if !dryRun {
+		purged, err := fs.purgeTrash()
+		if err != nil {
+			return nil, err
+		}
+		stats.Purged = purged
+	}
+
+	grace := fs.gcGracePeriod()
+	if fs.cfg.HistoryRetention > grace {
+		grace = fs.cfg.HistoryRetention
+	}
+	cutoff := time.Now().Add(-grace)
+
+	live, err := fs.liveContent()
+	if err != nil {
+		return nil, err
+	}
+	// content may be stored under a different name, see encryptStore
+	stored := map[string]bool{}
+	for name := range live {
+		for _, s := range fs.keys.storedNames(name) {
+			stored[s] = true
+		}
+	}
+
+	err = fs.blobs.List(func(info BlobInfo) error {
+		if stored[info.Name] {
+			stats.Live++
+			return nil
+		}
+		if info.ModTime.After(cutoff) {
+			stats.Kept++
+			return nil
+		}
+
+		stats.Removed++
+		stats.RemovedBytes += info.Size
+		if dryRun {
+			fmt.Println("gc: would remove", info.Name, info.Size)
+			return nil
+		}
+		return fs.blobs.Delete(info.Name)
+	})
+	if err == nil && !dryRun {
+		err = fs.removePartials(live, cutoff)
+	}
+	return stats, err
+}
+
+// removePartials removes the pieces of fetches that stopped before cutoff,
+// unless the content is still live.
+func (fs *AMFS) removePartials(live map[string]bool, cutoff time.Time) error {
+	entries, err := os.ReadDir(fs.path(partialDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || live[e.Name()] || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(fs.path(partialDir), e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveContent returns the names of all content referenced by the current
+// tree (including the versions in .amfs/history) or by the tree as it was
+// cfg.HistoryRetention ago.
+func (fs *AMFS) liveContent() (map[string]bool, error) {
+	live := map[string]bool{}
+	err := fs.view(func() error {
+		if err := markLive(fs.doc, live); err != nil {
+			return err
+		}
+		if fs.cfg.HistoryRetention <= 0 {
+			return nil
+		}
+
+		heads, err := headsAt(fs.doc, time.Now().Add(-fs.cfg.HistoryRetention))
+		if err != nil || len(heads) == 0 {
+			return err
+		}
+		old, err := fs.doc.Fork(heads...)
+		if err != nil {
+			return err
+		}
+		return markLive(old, live)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.markChunks(live); err != nil {
+		return nil, err
+	}
+	return live, nil
+}
+
+func (fs *AMFS) gcGracePeriod() time.Duration {
+	if fs.cfg.GCGracePeriod > 0 {
+		return fs.cfg.GCGracePeriod
+	}
+	return defaultGCGracePeriod
+}
+
+// markLive adds the names of all content referenced by doc to live.
+func markLive(doc *automerge.Doc, live map[string]bool) error {
+	files, err := automerge.As[map[AMID]*AMFile](doc.Path("files").Get())
+	if err != nil {
+		return err
+	}
+
+	for amid, file := range files {
+		if file == nil {
+			continue
+		}
+		switch file.Type {
+		case Blob:
+			for _, h := range file.Heads {
+				live[hex.EncodeToString(h)] = true
+			}
+		case Mergeable:
+			live[string(amid)] = true
+		}
+	}
+	return markVersions(doc, live)
+}
+
+// markChunks marks the chunks of every live chunked blob.
+func (fs *AMFS) markChunks(live map[string]bool) error {
+	heads := []string{}
+	for name := range live {
+		if len(name) == 64 {
+			heads = append(heads, name)
+		}
+	}
+
+	for _, name := range heads {
+		head, _ := hex.DecodeString(name)
+		chunks, err := fs.blobChunks(head)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, c := range chunks {
+			live[hex.EncodeToString(c.Hash)] = true
+		}
+	}
+	return nil
+}
+
+// isContentName reports whether name is a blob (a hex sha256) or a
+// mergeable doc (an AMID) in the data directory.
+func isContentName(name string) bool {
+	if len(name) == 64 {
+		_, err := hex.DecodeString(name)
+		return err == nil
+	}
+	if len(name) == 43 {
+		b, err := base64.RawURLEncoding.DecodeString(name)
+		return err == nil && len(b) == 32
+	}
+	return false
+}
+
+// headsAt returns the heads of doc including only changes made at or before
+// t. A change made before t that depends on a later one (because of clock
+// skew between peers) is excluded along with it.
+func headsAt(doc *automerge.Doc, t time.Time) ([]automerge.ChangeHash, error) {
+	changes, err := doc.Changes()
+	if err != nil {
+		return nil, err
+	}
+
+	included := map[automerge.ChangeHash]bool{}
+	depended := map[automerge.ChangeHash]bool{}
+	order := []automerge.ChangeHash{}
+
+	// changes are returned in causal order, so dependencies come first
+	for _, c := range changes {
+		if c.Timestamp().After(t) {
+			continue
+		}
+		ok := true
+		for _, d := range c.Dependencies() {
+			if !included[d] {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		included[c.Hash()] = true
+		order = append(order, c.Hash())
+		for _, d := range c.Dependencies() {
+			depended[d] = true
+		}
+	}
+
+	heads := []automerge.ChangeHash{}
+	for _, h := range order {
+		if !depended[h] {
+			heads = append(heads, h)
+		}
+	}
+	return heads, nil
+}
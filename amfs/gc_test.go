@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// storedBlobs returns the names of everything in the blob store.
+func storedBlobs(t *testing.T, fs *AMFS) map[string]bool {
+	t.Helper()
+	names := map[string]bool{}
+	err := fs.blobs.List(func(info BlobInfo) error {
+		names[info.Name] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestCollectGarbage(t *testing.T) {
+	c := testConfig(t)
+	c.GCGracePeriod = time.Nanosecond
+	c.HistoryRetention = 0
+	fs := openTestFS(t, c)
+	defer fs.Close()
+
+	// once replaced, the chunks of the first a.bin are only referenced by
+	// its version in .amfs/history
+	_, big := testBlob(t, 3*avgChunk)
+	writeTestFile(t, fs, "a.bin", string(big))
+	chunked := storedBlobs(t, fs)
+	if len(chunked) < 3 {
+		t.Fatalf("a.bin stored as %d blobs", len(chunked))
+	}
+	writeTestFile(t, fs, "a.bin", "small")
+	writeTestFile(t, fs, "b.txt", "b")
+	orphan, data := testBlob(t, 10)
+	if err := fs.blobs.Put(orphan, data); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	before := storedBlobs(t, fs)
+	stats, err := fs.collectGarbage(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed == 0 {
+		t.Fatalf("dry run would remove nothing: %v", stats)
+	}
+	if after := storedBlobs(t, fs); !reflect.DeepEqual(after, before) {
+		t.Fatalf("dry run removed %d blobs", len(before)-len(after))
+	}
+
+	if _, err := fs.collectGarbage(false); err != nil {
+		t.Fatal(err)
+	}
+	after := storedBlobs(t, fs)
+	if after[orphan] {
+		t.Fatal("unreferenced blob kept")
+	}
+	for name := range chunked {
+		if !after[name] {
+			t.Fatalf("removed %s of the first a.bin", name)
+		}
+	}
+	if got := readTestFile(t, fs, "a.bin"); got != "small" {
+		t.Fatalf("a.bin = %q", got)
+	}
+	if got := readTestFile(t, fs, "b.txt"); got != "b" {
+		t.Fatalf("b.txt = %q", got)
+	}
+	versions, err := fs.ReadDir(historyDir + "/a.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, v := range versions {
+		if readTestFile(t, fs, historyDir+"/a.bin/"+v.Name()) == string(big) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("first a.bin not in %d versions", len(versions))
+	}
+}
+
+func TestCollectGarbageGracePeriod(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	// as if its commit were still in flight
+	name, data := testBlob(t, 10)
+	if err := fs.blobs.Put(name, data); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := fs.collectGarbage(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 0 || stats.Kept != 1 {
+		t.Fatalf("collected %v", stats)
+	}
+	if has, _ := fs.blobs.Has(name); !has {
+		t.Fatal("blob removed within the grace period")
+	}
+}
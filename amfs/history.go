@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// Paths under .amfs/@<spec>/ show the tree as it was at some point in the
+// past. spec is either a comma separated list of change hashes (as shown by
+// the heads of the tree document), or a time:
+//
+//	@yesterday            24 hours ago
+//	@2h30m                that long ago (any time.ParseDuration string)
+//	@2023-06-01           midnight at the start of that day, local time
+//	@2023-06-01T15:04     that minute, local time
+//	@2023-06-01T15:04:05Z an RFC 3339 time
+//	@1685577600           a unix timestamp
+//
+// Historical trees are read-only.
+
+// historyCacheTTL is how long a resolved spec is reused for. Times like
+// "yesterday" move on, and changes made in the past can still be synced in.
+const historyCacheTTL = time.Minute
+const historyCacheSize = 16
+
+// historyCache keeps recently used historical trees, as forking the tree
+// document is expensive and NFS clients look up the same paths over and
+// over.
+type historyCache struct {
+	mu    sync.Mutex
+	trees map[string]*historyEntry
+}
+
+type historyEntry struct {
+	doc     *automerge.Doc
+	created time.Time
+}
+
+// historicalTree returns the tree document as it was at spec.
+// The caller must be inside fs.view.
+func (fs *AMFS) historicalTree(spec string) (*automerge.Doc, error) {
+	c := &fs.history
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.trees == nil {
+		c.trees = map[string]*historyEntry{}
+	}
+	if e := c.trees[spec]; e != nil && time.Since(e.created) < historyCacheTTL {
+		return e.doc, nil
+	}
+
+	heads, err := fs.resolveHistorySpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := fs.doc.Fork(heads...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.trees) >= historyCacheSize {
+		oldest := ""
+		for k, e := range c.trees {
+			if oldest == "" || e.created.Before(c.trees[oldest].created) {
+				oldest = k
+			}
+		}
+		delete(c.trees, oldest)
+	}
+	c.trees[spec] = &historyEntry{doc: doc, created: time.Now()}
+	return doc, nil
+}
+
+// resolveHistorySpec returns the heads of the tree document that spec
+// refers to.
+func (fs *AMFS) resolveHistorySpec(spec string) ([]automerge.ChangeHash, error) {
+	if heads, ok := parseHeads(spec); ok {
+		return heads, nil
+	}
+
+	t, err := parseHistoryTime(spec, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	heads, err := headsAt(fs.doc, t)
+	if err != nil {
+		return nil, err
+	}
+	if len(heads) == 0 {
+		return nil, fmt.Errorf("no history before %s", t.Format(time.RFC3339))
+	}
+	return heads, nil
+}
+
+// parseHeads parses a comma separated list of change hashes.
+func parseHeads(spec string) ([]automerge.ChangeHash, bool) {
+	heads := []automerge.ChangeHash{}
+	for _, s := range strings.Split(spec, ",") {
+		if len(s) != 64 {
+			return nil, false
+		}
+		h, err := automerge.NewChangeHash(s)
+		if err != nil {
+			return nil, false
+		}
+		heads = append(heads, h)
+	}
+	return heads, true
+}
+
+func parseHistoryTime(spec string, now time.Time) (time.Time, error) {
+	if spec == "yesterday" {
+		return now.Add(-24 * time.Hour), nil
+	}
+	if d, err := time.ParseDuration(spec); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if unix, err := strconv.ParseInt(spec, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, spec, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %#v", spec)
+}
+
+// forkAt returns doc as it was at heads.
+func forkAt(doc *automerge.Doc, heads [][]byte) (*automerge.Doc, error) {
+	hashes := []automerge.ChangeHash{}
+	for _, h := range heads {
+		var hash automerge.ChangeHash
+		if len(h) != len(hash) {
+			return nil, fmt.Errorf("invalid head %x", h)
+		}
+		copy(hash[:], h)
+		hashes = append(hashes, hash)
+	}
+	return doc.Fork(hashes...)
+}
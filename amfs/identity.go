@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// Each daemon has an ed25519 identity, generated on first start and kept
+// in the data directory. Its public key, in hex, is the daemon's automerge
+// actor ID, so every change to the tree records which daemon made it, and
+// is what other daemons list in cfg.PeerKeys to trust it. The same actor
+// ID is used for the mergeable docs, and the tree maps each actor ID to
+// the daemon's cfg.Name so that people can see who made a change:
+//
+//	actors: {<actor id>: <name>}
+//
+// Peer connections use TLS 1.3 with both ends presenting a self-signed
+// certificate for their identity. There is no certificate authority: a
+// connection is accepted only if the other end proves it holds the private
+// key for one of cfg.PeerKeys.
+//
+// A copy of a data directory has the same identity, so to start a new
+// daemon from a copy remove its identity file first.
+
+// identityFile holds the daemon's private key as a PEM encoded PKCS #8
+// key. Unlike the rest of the data directory it is not encrypted, so it is
+// only readable by its owner.
+const identityFile = "identity"
+
+// loadIdentity reads the identity from the data directory, creating it if
+// there is none yet.
+func loadIdentity(dir string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dir, identityFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return newIdentity(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return priv, nil
+}
+
+func newIdentity(path string) (ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := writeFileAtomic(path, data, 0o600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// publicKey returns the hex encoded public key of an identity, which is
+// also its actor ID.
+func publicKey(priv ed25519.PrivateKey) string {
+	return hex.EncodeToString(priv.Public().(ed25519.PublicKey))
+}
+
+// peerTLS returns the TLS config for connections to and from peers.
+func (fs *AMFS) peerTLS() (*tls.Config, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, fs.identity.Public(), fs.identity)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted := map[string]bool{}
+	for _, k := range fs.cfg.PeerKeys {
+		trusted[strings.ToLower(strings.TrimSpace(k))] = true
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: fs.identity}},
+		ClientAuth:   tls.RequireAnyClientCert,
+		// the certificates are self-signed, so instead of verifying a chain
+		// the key is checked against the trusted ones
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(certs [][]byte, _ [][]*x509.Certificate) error {
+			key, err := certificateKey(certs)
+			if err != nil {
+				return err
+			}
+			if !trusted[key] {
+				return fmt.Errorf("untrusted peer key %s", key)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// certificateKey returns the hex encoded ed25519 key of the first
+// certificate.
+func certificateKey(certs [][]byte) (string, error) {
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no certificate")
+	}
+	cert, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return "", err
+	}
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("not an ed25519 certificate")
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// peerKey returns the hex encoded key that the other end of a peer
+// connection authenticated with.
+func peerKey(c net.Conn) (string, error) {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return "", fmt.Errorf("not a TLS connection")
+	}
+	certs := [][]byte{}
+	for _, cert := range tc.ConnectionState().PeerCertificates {
+		certs = append(certs, cert.Raw)
+	}
+	return certificateKey(certs)
+}
+
+// nameActor records the name of the daemon in the tree, unless it is
+// already there. It runs again after syncing with a peer, in case the
+// actors map was created concurrently on both and only the peer's was kept.
+// The caller must be inside fs.update.
+func (fs *AMFS) nameActor() error {
+	name := fs.cfg.Name
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	if name == "" {
+		return nil
+	}
+	actor := fs.doc.ActorID()
+	current, err := automerge.As[string](fs.doc.Path("actors", actor).Get())
+	if err != nil || current == name {
+		return err
+	}
+	return fs.Tx().
+		Set("actors", actor).To(name).
+		Describe("name %s %s", actor, name).
+		Commit()
+}
+
+// actorName returns the name of the daemon with the given actor ID, or
+// the start of the ID if it has none.
+// The caller must be inside fs.view.
+func (fs *AMFS) actorName(actor string) string {
+	name, err := automerge.As[string](fs.doc.Path("actors", actor).Get())
+	if err == nil && name != "" {
+		return name
+	}
+	if len(actor) > 8 {
+		return actor[:8]
+	}
+	return actor
+}
+
+// changeLog describes the last n changes to the tree, newest first, one
+// line per change.
+func (fs *AMFS) changeLog(n int) ([]string, error) {
+	lines := []string{}
+	err := fs.view(func() error {
+		changes, err := fs.doc.Changes()
+		if err != nil {
+			return err
+		}
+		for i := len(changes) - 1; i >= 0 && len(lines) < n; i-- {
+			c := changes[i]
+			msg := c.Message()
+			if msg == "" {
+				msg = "(no description)"
+			}
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%s",
+				c.Timestamp().UTC().Format(time.RFC3339), fs.actorName(c.ActorID()), msg))
+		}
+		return nil
+	})
+	return lines, err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// handshake connects a client with config client to a server with config
+// server, and returns the errors each end saw and the key the server saw.
+func handshake(t *testing.T, client, server *tls.Config) (clientErr, serverErr error, key string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, ts := tls.Client(c, client), tls.Server(s, server)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if serverErr = ts.Handshake(); serverErr == nil {
+			key, serverErr = peerKey(ts)
+			// in TLS 1.3 the server checks the client's certificate after
+			// the client has finished, so tell it whether that worked
+			_, serverErr = ts.Write([]byte{1})
+		}
+		ts.Close()
+	}()
+	if clientErr = tc.Handshake(); clientErr == nil {
+		_, clientErr = tc.Read(make([]byte, 1))
+	}
+	tc.Close()
+	<-done
+	return clientErr, serverErr, key
+}
+
+func testTLS(t *testing.T, fs *AMFS) *tls.Config {
+	config, err := fs.peerTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestPeerTLS(t *testing.T) {
+	a := openTestFS(t, testConfig(t))
+	defer a.Close()
+	b := openTestFS(t, testConfig(t))
+	defer b.Close()
+	c := openTestFS(t, testConfig(t))
+	defer c.Close()
+	a.cfg.PeerKeys = []string{publicKey(b.identity), publicKey(c.identity)}
+	b.cfg.PeerKeys = []string{publicKey(a.identity)}
+
+	clientErr, serverErr, key := handshake(t, testTLS(t, b), testTLS(t, a))
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("b to a: %v, %v", clientErr, serverErr)
+	}
+	if key != publicKey(b.identity) {
+		t.Fatalf("a saw key %s", key)
+	}
+
+	// b doesn't know c, whichever end it is
+	if _, serverErr, _ := handshake(t, testTLS(t, c), testTLS(t, b)); serverErr == nil {
+		t.Fatal("b accepted a connection from c")
+	}
+	if clientErr, _, _ := handshake(t, testTLS(t, b), testTLS(t, c)); clientErr == nil {
+		t.Fatal("b connected to c")
+	}
+}
+
+func TestPeerTLSNoPeers(t *testing.T) {
+	a := openTestFS(t, testConfig(t))
+	defer a.Close()
+	b := openTestFS(t, testConfig(t))
+	defer b.Close()
+	b.cfg.PeerKeys = []string{publicKey(a.identity)}
+
+	if _, serverErr, _ := handshake(t, testTLS(t, b), testTLS(t, a)); serverErr == nil {
+		t.Fatal("a accepted a connection without any peers")
+	}
+	if clientErr, _, _ := handshake(t, testTLS(t, a), testTLS(t, b)); clientErr == nil {
+		t.Fatal("a connected without any peers")
+	}
+}
+
+func TestPeerTLSNotEd25519(t *testing.T) {
+	a := openTestFS(t, testConfig(t))
+	defer a.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certificateKey([][]byte{der}); err == nil {
+		t.Fatal("read an ed25519 key from an ECDSA certificate")
+	}
+
+	client := &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		InsecureSkipVerify: true,
+	}
+	if _, serverErr, _ := handshake(t, client, testTLS(t, a)); serverErr == nil {
+		t.Fatal("accepted an ECDSA certificate")
+	}
+}
+
+func TestIdentityKept(t *testing.T) {
+	c := testConfig(t)
+	fs := openTestFS(t, c)
+	key := publicKey(fs.identity)
+	if actor := fs.doc.ActorID(); actor != key {
+		t.Fatalf("actor %s for key %s", actor, key)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(c.DataDir, identityFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("identity mode = %v", perm)
+	}
+
+	fs = openTestFS(t, c)
+	defer fs.Close()
+	if got := publicKey(fs.identity); got != key {
+		t.Fatalf("restarted as %s, not %s", got, key)
+	}
+	if actor := fs.doc.ActorID(); actor != key {
+		t.Fatalf("restarted with actor %s", actor)
+	}
+}
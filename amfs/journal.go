@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// journalFile holds the incremental changes made since folder.automerge was
+// last written. While a compaction is running the old journal is kept
+// under oldJournalFile until the new snapshot is safely on disk.
+const journalFile = "folder.journal"
+const oldJournalFile = "folder.journal.old"
+
+// defaultCompactBytes is the journal size after which a new snapshot is
+// written, if the config does not say otherwise.
+const defaultCompactBytes = 8 * 1024 * 1024
+
+// journal is an append-only log of automerge incremental saves.
+// Each record is a 4 byte length, a 4 byte crc32 and the payload, so that
+// a record torn by a crash can be detected and dropped.
+type journal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+	// broken is set when changes could not be appended. They are only in
+	// the doc, so nothing more is appended until a snapshot has saved them.
+	broken bool
+}
+
+// openJournal opens (or creates) the journal at path, returning the records
+// it already contains. A damaged tail is truncated away.
+func openJournal(path string) (*journal, [][]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, size, err := readJournal(f)
+	if err != nil {
+		fmt.Println("RECOVERY: dropping damaged journal tail of", path, "after", len(records), "records:", err)
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &journal{path: path, f: f, size: size}, records, nil
+}
+
+// readJournalFile returns the intact records of the journal at path, or none
+// if it does not exist.
+func readJournalFile(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, _, err := readJournal(f)
+	if err != nil {
+		fmt.Println("RECOVERY: ignoring damaged tail of", path, "after", len(records), "records:", err)
+	}
+	return records, nil
+}
+
+// readJournal reads records until EOF. It returns the records and the offset
+// of the end of the last good record, and an error if the tail was damaged.
+func readJournal(r io.Reader) ([][]byte, int64, error) {
+	records := [][]byte{}
+	offset := int64(0)
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return records, offset, nil
+			}
+			return records, offset, err
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		if length > 1<<30 {
+			return records, offset, fmt.Errorf("invalid record length %d", length)
+		}
+
+		record := make([]byte, length)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return records, offset, err
+		}
+		if crc32.ChecksumIEEE(record) != sum {
+			return records, offset, fmt.Errorf("checksum mismatch")
+		}
+
+		records = append(records, record)
+		offset += int64(len(header)) + int64(length)
+	}
+}
+
+// append durably adds a record to the journal.
+// The caller must hold j.mu.
+func (j *journal) append(record []byte) error {
+	buf := make([]byte, 8+len(record))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(record))
+	copy(buf[8:], record)
+
+	if _, err := j.f.Write(buf); err != nil {
+		// don't leave a partial record for the next append to follow
+		j.f.Truncate(j.size)
+		j.f.Seek(j.size, io.SeekStart)
+		return err
+	}
+	j.size += int64(len(buf))
+	return j.f.Sync()
+}
+
+// rotate moves the current journal to oldPath and starts a new empty one.
+// If oldPath is still present from a compaction that failed, the records
+// are added to the end of it instead.
+// The caller must hold j.mu.
+func (j *journal) rotate(oldPath string) error {
+	if _, err := os.Stat(oldPath); err == nil {
+		return j.moveInto(oldPath)
+	}
+	if err := os.Rename(j.path, oldPath); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return err
+	}
+	j.f.Close()
+	j.f = f
+	j.size = 0
+	return nil
+}
+
+func (j *journal) moveInto(oldPath string) error {
+	old, err := os.OpenFile(oldPath, os.O_WRONLY|os.O_APPEND, 0o666)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(old, j.f); err != nil {
+		return err
+	}
+	if err := old.Sync(); err != nil {
+		return err
+	}
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	_, err = j.f.Seek(0, io.SeekStart)
+	return err
+}
+
+// persist appends the changes committed since the last save to the journal,
+// and starts a compaction if the journal has grown too large.
+// The caller must be inside fs.update.
+func (fs *AMFS) persist() error {
+	fs.journal.mu.Lock()
+	defer fs.journal.mu.Unlock()
+
+	if fs.journal.broken {
+		return fs.rewriteSnapshot()
+	}
+	changes := fs.doc.SaveIncremental()
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := fs.journal.append(fs.keys.seal(journalFile, changes)); err != nil {
+		fs.journal.broken = true
+		return err
+	}
+
+	if fs.journal.size > fs.compactBytes() {
+		go fs.compact()
+	}
+	return nil
+}
+
+func (fs *AMFS) compactBytes() int64 {
+	if fs.cfg.JournalCompactBytes > 0 {
+		return fs.cfg.JournalCompactBytes
+	}
+	return defaultCompactBytes
+}
+
+// compact writes a full snapshot of the tree document and discards the
+// journal entries it covers. Commits can continue while the snapshot is
+// being written; they go to a fresh journal.
+func (fs *AMFS) compact() {
+	if !fs.compacting.CompareAndSwap(false, true) {
+		return
+	}
+	defer fs.compacting.Store(false)
+
+	if err := fs.writeSnapshot(); err != nil {
+		fmt.Println("ERROR: compacting journal:", err)
+	}
+}
+
+// compactNow is like compact, but waits for a compaction that is already
+// running to finish and then writes a new snapshot anyway.
+func (fs *AMFS) compactNow() error {
+	for !fs.compacting.CompareAndSwap(false, true) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer fs.compacting.Store(false)
+
+	return fs.writeSnapshot()
+}
+
+func (fs *AMFS) writeSnapshot() error {
+	// Save would commit a transaction that is being built, so keep writers out
+	fs.mu.RLock()
+	fs.journal.mu.Lock()
+	snapshot := fs.doc.Save()
+	err := fs.journal.rotate(fs.path(oldJournalFile))
+	broken := fs.journal.broken
+	if err == nil {
+		fs.journal.broken = false
+	}
+	fs.journal.mu.Unlock()
+	fs.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := fs.saveSnapshot(snapshot); err != nil {
+		if broken {
+			// the snapshot was the only copy of the unjournalled changes
+			fs.journal.mu.Lock()
+			fs.journal.broken = true
+			fs.journal.mu.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+// rewriteSnapshot writes a snapshot of the tree document in place of the
+// journal, after changes could not be appended to it.
+// The caller must be inside fs.update and hold fs.journal.mu.
+func (fs *AMFS) rewriteSnapshot() error {
+	// a compaction that is writing its snapshot may not have the changes,
+	// and would remove the journal this rotates
+	if !fs.compacting.CompareAndSwap(false, true) {
+		return fmt.Errorf("%s: waiting for compaction to save changes that could not be journalled", fs.journal.path)
+	}
+	defer fs.compacting.Store(false)
+
+	snapshot := fs.doc.Save()
+	if err := fs.journal.rotate(fs.path(oldJournalFile)); err != nil {
+		return err
+	}
+	if err := fs.saveSnapshot(snapshot); err != nil {
+		return err
+	}
+	fs.journal.broken = false
+	return nil
+}
+
+// saveSnapshot writes a snapshot of the tree document and removes the
+// journal it replaces, which rotate moved to oldJournalFile.
+func (fs *AMFS) saveSnapshot(snapshot []byte) error {
+	if err := fs.saveDoc(snapshot); err != nil {
+		return err
+	}
+	if err := os.Remove(fs.path(oldJournalFile)); err != nil {
+		return err
+	}
+	return syncDir(fs.dir)
+}
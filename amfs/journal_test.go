@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	c := testConfig(t)
+	c.BlobStore = "local"
+	fs := openTestFS(t, c)
+	writeTestFile(t, fs, "a.txt", "a")
+	for _, dir := range []string{"d", "d/e"} {
+		if err := fs.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, fs, "d/e/b.txt", "b")
+	fs.Close()
+
+	if info, err := os.Stat(filepath.Join(c.DataDir, journalFile)); err != nil || info.Size() == 0 {
+		t.Fatalf("journal not written: %v", err)
+	}
+	fs = openTestFS(t, c)
+	defer fs.Close()
+	if got := readTestFile(t, fs, "a.txt"); got != "a" {
+		t.Fatalf("a.txt = %q", got)
+	}
+	if got := readTestFile(t, fs, "d/e/b.txt"); got != "b" {
+		t.Fatalf("d/e/b.txt = %q", got)
+	}
+}
+
+func TestJournalTruncatedTail(t *testing.T) {
+	c := testConfig(t)
+	c.BlobStore = "local"
+	fs := openTestFS(t, c)
+	writeTestFile(t, fs, "a.txt", "a")
+	fs.Close()
+
+	path := filepath.Join(c.DataDir, journalFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := info.Size()
+
+	// a record torn by a crash part way through being written
+	fs = openTestFS(t, c)
+	writeTestFile(t, fs, "b.txt", "b")
+	fs.Close()
+	if info, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = openTestFS(t, c)
+	if got := readTestFile(t, fs, "a.txt"); got != "a" {
+		t.Fatalf("a.txt = %q", got)
+	}
+	if info, err = os.Stat(path); err != nil || info.Size() < good {
+		t.Fatalf("journal truncated to %d bytes, want at least %d: %v", info.Size(), good, err)
+	}
+	// later records must not follow the damaged one
+	writeTestFile(t, fs, "c.txt", "c")
+	fs.Close()
+
+	fs = openTestFS(t, c)
+	defer fs.Close()
+	if got := readTestFile(t, fs, "c.txt"); got != "c" {
+		t.Fatalf("c.txt = %q", got)
+	}
+}
+
+func TestJournalGarbageTail(t *testing.T) {
+	c := testConfig(t)
+	c.BlobStore = "local"
+	fs := openTestFS(t, c)
+	writeTestFile(t, fs, "a.txt", "a")
+	fs.Close()
+
+	f, err := os.OpenFile(filepath.Join(c.DataDir, journalFile), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 4, 1, 2, 3, 4, 'j', 'u', 'n', 'k'})
+	f.Close()
+
+	fs = openTestFS(t, c)
+	defer fs.Close()
+	if got := readTestFile(t, fs, "a.txt"); got != "a" {
+		t.Fatalf("a.txt = %q", got)
+	}
+}
+
+func TestJournalAppendFailure(t *testing.T) {
+	c := testConfig(t)
+	c.BlobStore = "local"
+	fs := openTestFS(t, c)
+	writeTestFile(t, fs, "a.txt", "a")
+
+	// make the next append fail, as it would with a full disk
+	fs.journal.f.Close()
+	if err := fs.MkdirAll("d", 0o755); err == nil {
+		t.Fatal("commit succeeded without being journalled")
+	}
+	if !fs.journal.broken {
+		t.Fatal("journal not marked broken")
+	}
+	// the next commit saves everything, including the change that failed
+	if err := fs.MkdirAll("e", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	fs = openTestFS(t, c)
+	defer fs.Close()
+	for _, name := range []string{"a.txt", "d", "e"} {
+		if _, err := fs.Stat(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ConradIrwin/parallel"
+	"github.com/automerge/automerge-go"
+)
+
+// Daemons replicate the tree document between themselves with the automerge
+// sync protocol over TLS (see identity.go). Each daemon listens on
+// cfg.PeerListen and dials every address in cfg.Peers. Once connected both
+// ends run the same protocol:
+//
+//	HELLO <actor id>\n
+//	SYNC <length>\n<sync message>\n
+//	...
+//
+// The actor ID in HELLO must be the key the peer authenticated with.
+//
+// Each side keeps a SyncState for each peer, by the peer's actor ID so that
+// it outlasts the connection, and sends a sync message whenever the tree
+// changes or the peer has sent one. Changes from a peer are merged into the
+// tree and persisted like any other commit.
+//
+// File content is exchanged over the same connection, see fetch.go.
+//
+// Trees can only be replicated if they have the same ROOT, which is true of
+// any two created by newTree. A tree from before then can only be replicated
+// to peers that started from a copy of its data directory.
+
+// maxPeerMessage limits the size of a sync message. The first sync with a
+// new peer sends every change to the tree, so this is much larger than the
+// limit for editors.
+const maxPeerMessage = 256 * 1024 * 1024
+
+// peerRetryInterval is how long to wait before reconnecting to a peer.
+const peerRetryInterval = 5 * time.Second
+
+// peerStates is what the tree's peers need to share.
+type peerStates struct {
+	mu sync.Mutex
+	// saved holds the sync state of each peer that has disconnected
+	saved map[string][]byte
+	// savedDocs holds the sync states of the mergeable docs of each peer
+	// that has disconnected
+	savedDocs map[string]map[AMID][]byte
+	// changed is closed (and replaced) whenever the tree changes
+	changed chan struct{}
+	// conns are the connected peers
+	conns map[*peerConn]bool
+	// fetches are the blobs being fetched from peers, by name
+	fetches map[string]*fetch
+}
+
+// peerConn is a connection to another daemon.
+type peerConn struct {
+	peer string
+
+	mu sync.Mutex
+	// queue holds messages waiting to be written, so that the reader never
+	// blocks on the connection (which could deadlock if the peer's reader
+	// did too)
+	queue [][]byte
+	ready chan struct{}
+
+	// docs holds the sync state of each mergeable doc, and sent the heads
+	// the tree had for it when a sync message was last generated.
+	// Both are guarded by fs.mergeable.mu.
+	docs map[AMID]*automerge.SyncState
+	sent map[AMID]string
+	// files collects the files that change, so that only their docs are
+	// checked for something to send
+	files *fileWatch
+	// sending holds the blobs being sent to the peer, see receiveGet. It is
+	// only used by the reader.
+	sending map[string][]byte
+}
+
+// send queues a message for the peer.
+func (pc *peerConn) send(line string) {
+	pc.enqueue([]byte(line + "\n"))
+}
+
+// sendPayload queues a message for the peer that is followed by a payload.
+func (pc *peerConn) sendPayload(line string, payload []byte) {
+	msg := append([]byte(line+"\n"), payload...)
+	pc.enqueue(append(msg, '\n'))
+}
+
+func (pc *peerConn) enqueue(msg []byte) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.queue = append(pc.queue, msg)
+	select {
+	case pc.ready <- struct{}{}:
+	default:
+	}
+}
+
+// flush writes the queued messages to w.
+func (pc *peerConn) flush(w *bufio.Writer) error {
+	pc.mu.Lock()
+	queue := pc.queue
+	pc.queue = nil
+	pc.mu.Unlock()
+
+	for _, msg := range queue {
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// wait returns a channel that is closed the next time the tree changes.
+func (ps *peerStates) wait() <-chan struct{} {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.changed == nil {
+		ps.changed = make(chan struct{})
+	}
+	return ps.changed
+}
+
+// notify wakes everything waiting for the tree to change.
+func (ps *peerStates) notify() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.changed != nil {
+		close(ps.changed)
+		ps.changed = nil
+	}
+}
+
+// connected reports whether any peers are connected.
+func (ps *peerStates) connected() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.conns) > 0
+}
+
+// servePeers accepts connections from other daemons.
+func (fs *AMFS) servePeers(ctx context.Context, l net.Listener) {
+	config, err := fs.peerTLS()
+	if err != nil {
+		fmt.Println("ERROR: serving peers:", err)
+		l.Close()
+		return
+	}
+	l = tls.NewListener(l, config)
+
+	parallel.Do(func(p *parallel.P) {
+		p.OnPanic = func(pnk any) bool {
+			fmt.Println("PANIC", pnk)
+			debug.PrintStack()
+			l.Close()
+			return true
+		}
+
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				panic(err)
+			}
+
+			p.Go(func() {
+				defer c.Close()
+				if err := fs.syncPeer(ctx, c); err != nil {
+					fmt.Println("peer", c.RemoteAddr(), "disconnected:", err)
+				}
+			})
+		}
+	})
+}
+
+// dialPeer keeps a connection open to the daemon at addr.
+func (fs *AMFS) dialPeer(ctx context.Context, addr string) {
+	config, err := fs.peerTLS()
+	if err != nil {
+		fmt.Println("ERROR: connecting to peer", addr+":", err)
+		return
+	}
+	for {
+		c, err := tls.Dial("tcp", addr, config)
+		if err == nil {
+			fmt.Println("peer", addr, "connected")
+			err = fs.syncPeer(ctx, c)
+			c.Close()
+		}
+		fmt.Println("peer", addr, "disconnected:", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(peerRetryInterval):
+		}
+	}
+}
+
+// syncPeer runs the sync protocol on c until the connection is closed.
+func (fs *AMFS) syncPeer(ctx context.Context, c net.Conn) error {
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+
+	var actor string
+	fs.view(func() error {
+		actor = fs.doc.ActorID()
+		return nil
+	})
+	if _, err := w.WriteString("HELLO " + actor + "\n"); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	cmd, peer, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+	if cmd != "HELLO" || peer == "" {
+		return fmt.Errorf("unexpected greeting: %#v", line)
+	}
+	if peer == actor {
+		return fmt.Errorf("connected to itself")
+	}
+	key, err := peerKey(c)
+	if err != nil {
+		return err
+	}
+	if peer != key {
+		return fmt.Errorf("peer with key %s said it was %s", key, peer)
+	}
+
+	state, err := fs.peerState(peer)
+	if err != nil {
+		return err
+	}
+	pc := fs.connectPeer(peer)
+	defer func() {
+		fs.update(func() error {
+			fs.peers.mu.Lock()
+			defer fs.peers.mu.Unlock()
+			fs.peers.saved[peer] = state.Save()
+			return nil
+		})
+		fs.disconnectPeer(pc)
+	}()
+
+	// the reader closes done when the connection fails, which stops the
+	// writer
+	done := make(chan struct{})
+	var readErr error
+	var writeErr error
+	parallel.Do(func(p *parallel.P) {
+		p.Go(func() {
+			defer close(done)
+			readErr = fs.receivePeer(r, pc, state)
+		})
+
+		for {
+			changed := fs.peers.wait()
+			var msg []byte
+			var valid bool
+			fs.update(func() error {
+				msg, valid = state.GenerateMessage()
+				return nil
+			})
+			if valid {
+				pc.sendPayload("SYNC "+fmt.Sprint(len(msg)), msg)
+			}
+			if writeErr = fs.syncDocs(pc); writeErr != nil {
+				c.Close()
+				return
+			}
+			if writeErr = pc.flush(w); writeErr != nil {
+				c.Close()
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-pc.ready:
+			case <-done:
+				return
+			case <-ctx.Done():
+				c.Close()
+				return
+			}
+		}
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return readErr
+}
+
+// peerState returns the sync state for peer, resuming from where the last
+// connection to it left off.
+func (fs *AMFS) peerState(peer string) (*automerge.SyncState, error) {
+	var state *automerge.SyncState
+	err := fs.view(func() error {
+		fs.peers.mu.Lock()
+		defer fs.peers.mu.Unlock()
+		if fs.peers.saved == nil {
+			fs.peers.saved = map[string][]byte{}
+		}
+		if saved, ok := fs.peers.saved[peer]; ok {
+			var err error
+			state, err = automerge.LoadSyncState(fs.doc, saved)
+			return err
+		}
+		state = automerge.NewSyncState(fs.doc)
+		return nil
+	})
+	return state, err
+}
+
+// receivePeer handles the messages read from r until the connection fails.
+func (fs *AMFS) receivePeer(r *bufio.Reader, pc *peerConn, state *automerge.SyncState) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		cmd, tail, _ := strings.Cut(line, " ")
+
+		switch cmd {
+		case "SYNC":
+			msg, err := readPayload(r, tail)
+			if err != nil {
+				return err
+			}
+			err = fs.update(func() error {
+				if err := state.ReceiveMessage(msg); err != nil {
+					return err
+				}
+				if err := fs.persist(); err != nil {
+					return err
+				}
+				return fs.nameActor()
+			})
+			if err != nil {
+				return err
+			}
+			// wake the writer to reply, and the other peers to pass the
+			// changes on
+			fs.peers.notify()
+
+		case "DOCSYNC":
+			id, size, _ := strings.Cut(tail, " ")
+			msg, err := readPayload(r, size)
+			if err != nil {
+				return err
+			}
+			if err := fs.receiveDoc(pc, AMID(id), msg); err != nil {
+				return err
+			}
+
+		case "WANT":
+			fs.receiveWant(pc, strings.Fields(tail))
+		case "HAVE":
+			fs.receiveHave(pc, strings.Fields(tail))
+		case "NOTHAVE":
+			fs.receiveNotHave(pc, strings.Fields(tail))
+		case "GET":
+			name, offset, _ := strings.Cut(tail, " ")
+			fs.receiveGet(pc, name, offset)
+
+		case "DATA":
+			// DATA <name> <offset> <total> <length>
+			fields := strings.Fields(tail)
+			if len(fields) != 4 {
+				return fmt.Errorf("unexpected command: %#v", line)
+			}
+			data, err := readPayload(r, fields[3])
+			if err != nil {
+				return err
+			}
+			offset, err1 := strconv.ParseInt(fields[1], 10, 64)
+			total, err2 := strconv.ParseInt(fields[2], 10, 64)
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("unexpected command: %#v", line)
+			}
+			fs.receiveData(pc, fields[0], offset, total, data)
+
+		default:
+			return fmt.Errorf("unexpected command: %#v", line)
+		}
+	}
+}
+
+// readPayload reads the payload of a message, which is followed by a
+// newline.
+func readPayload(r *bufio.Reader, size string) ([]byte, error) {
+	l, err := strconv.Atoi(size)
+	if err != nil || l < 0 || l > maxPeerMessage {
+		return nil, fmt.Errorf("invalid size: %#v", size)
+	}
+	msg := make([]byte, l+1)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg[:l], nil
+}
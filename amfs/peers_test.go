@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor waits for ok to hold, which it must within a few seconds.
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPeersReplicate(t *testing.T) {
+	a := openTestFS(t, testConfig(t))
+	defer a.Close()
+	b := openTestFS(t, testConfig(t))
+	defer b.Close()
+	a.cfg.PeerKeys = []string{publicKey(b.identity)}
+	b.cfg.PeerKeys = []string{publicKey(a.identity)}
+
+	// written before they are connected
+	writeTestFile(t, a, "a.txt", "from a")
+	if err := b.MkdirAll("b", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// servePeers runs until the process exits, so the test stops the
+	// connection from b's end and waits for a to notice
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer waitFor(t, "a to disconnect", func() bool { return !a.peers.connected() })
+	defer wg.Wait()
+	defer cancel()
+	go a.servePeers(ctx, l)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.dialPeer(ctx, l.Addr().String())
+	}()
+
+	waitFor(t, "a.txt on b", func() bool {
+		_, err := b.Stat("a.txt")
+		return err == nil
+	})
+	if got := readTestFile(t, b, "a.txt"); got != "from a" {
+		t.Fatalf("a.txt on b = %q", got)
+	}
+	waitFor(t, "b on a", func() bool {
+		info, err := a.Stat("b")
+		return err == nil && info.IsDir()
+	})
+
+	// written while they are connected
+	writeTestFile(t, b, "b/c.txt", "from b")
+	waitFor(t, "b/c.txt on a", func() bool {
+		_, err := a.Stat("b/c.txt")
+		return err == nil
+	})
+	if got := readTestFile(t, a, "b/c.txt"); got != "from b" {
+		t.Fatalf("b/c.txt on a = %q", got)
+	}
+
+	waitFor(t, "the trees to match", func() bool {
+		var ah, bh string
+		a.view(func() error {
+			ah = headsKey(a.doc)
+			return nil
+		})
+		b.view(func() error {
+			bh = headsKey(b.doc)
+			return nil
+		})
+		return ah == bh
+	})
+}
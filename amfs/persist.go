@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// prevSuffix is appended to the tree document's name to find the
+// previous generation, which is kept in case the current one is damaged.
+const prevSuffix = ".prev"
+
+// writeFileAtomic replaces path with data so that after a crash the file
+// contains either its old content or the new content, never a mixture.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, "."+name+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes directory entries (e.g. after a rename) to disk.
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// saveDoc atomically writes the tree document, keeping the version it
+// replaces as the previous generation.
+func (fs *AMFS) saveDoc(data []byte) error {
+	cur := fs.path(folderFile)
+	prev := cur + prevSuffix
+
+	if err := os.Remove(prev); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(cur, prev); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeFileAtomic(cur, fs.keys.seal(folderFile, data), 0o666)
+}
+
+// docRecovery describes falling back to the previous generation of the
+// tree document because the current one could not be loaded. Anything
+// saved only in the damaged generation is lost, so the daemon refuses to
+// start from the previous one unless cfg.Recover is set.
+type docRecovery struct {
+	// damaged is the current generation, and err why it could not be loaded
+	damaged string
+	err     error
+	// saved is when the previous generation was written
+	saved time.Time
+	// lost is the number of journal records (each the changes saved by one
+	// commit or sync) that build on changes only the damaged generation
+	// had, and so can't be replayed
+	lost int
+}
+
+func (r *docRecovery) Error() string {
+	return fmt.Sprintf("could not load %s: %v; the previous generation saved at %s loses %d journalled updates and any others made before the damaged one was written (start with -recover to use it anyway)",
+		r.damaged, r.err, r.saved.Format(time.RFC3339), r.lost)
+}
+
+// loadDoc reads the tree document. If the current generation is missing
+// or cannot be loaded it returns the previous generation, and a
+// docRecovery that says what happened; see recover.
+// It returns os.ErrNotExist if neither generation exists.
+func (fs *AMFS) loadDoc() (*automerge.Doc, *docRecovery, error) {
+	cur := fs.path(folderFile)
+	prev := cur + prevSuffix
+
+	fs.removeTempFiles()
+
+	doc, curErr := fs.loadDocFile(cur)
+	if curErr == nil {
+		return doc, nil, nil
+	}
+
+	doc, prevErr := fs.loadDocFile(prev)
+	if prevErr != nil {
+		if errors.Is(curErr, os.ErrNotExist) && errors.Is(prevErr, os.ErrNotExist) {
+			return nil, nil, os.ErrNotExist
+		}
+		return nil, nil, fmt.Errorf("loading %s: %w (previous generation: %v)", cur, curErr, prevErr)
+	}
+
+	prevStat, err := os.Stat(prev)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, &docRecovery{damaged: cur, err: curErr, saved: prevStat.ModTime()}, nil
+}
+
+// recover continues from the previous generation of the tree document:
+// the damaged generation is moved aside, and doc is written in its place so
+// that the next save keeps a good previous generation.
+func (fs *AMFS) recover(r *docRecovery, doc *automerge.Doc) error {
+	fmt.Println("RECOVERY: could not load", r.damaged+":", r.err)
+	fmt.Println("RECOVERY: using the previous generation saved at", r.saved.Format(time.RFC3339)+";",
+		r.lost, "journalled updates could not be replayed onto it and are lost,",
+		"as are any others made before the damaged generation was written")
+
+	if stat, err := os.Stat(r.damaged); err == nil {
+		aside := r.damaged + ".corrupt-" + strconv.FormatInt(time.Now().Unix(), 10)
+		if err := os.Rename(r.damaged, aside); err != nil {
+			return err
+		}
+		fmt.Println("RECOVERY: damaged", r.damaged, "of", stat.Size(), "bytes written at",
+			stat.ModTime().Format(time.RFC3339), "moved to", aside)
+	} else {
+		fmt.Println("RECOVERY:", r.damaged, "was missing")
+	}
+
+	return writeFileAtomic(r.damaged, fs.keys.seal(folderFile, doc.Save()), 0o666)
+}
+
+func (fs *AMFS) loadDocFile(path string) (*automerge.Doc, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	if bytes, err = fs.keys.open(folderFile, bytes); err != nil {
+		return nil, err
+	}
+	return automerge.Load(bytes)
+}
+
+// removeTempFiles cleans up temporary files left by writes that were
+// interrupted by a crash.
+func (fs *AMFS) removeTempFiles() {
+	matches, _ := filepath.Glob(fs.path(".*.tmp-*"))
+	for _, m := range matches {
+		fmt.Println("removing incomplete write", m)
+		os.Remove(m)
+	}
+}
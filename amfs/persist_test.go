@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadDocRecovery(t *testing.T) {
+	c := testConfig(t)
+	c.BlobStore = "local"
+	fs := openTestFS(t, c)
+	writeTestFile(t, fs, "a.txt", "a")
+	if err := fs.compactNow(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, fs, "b.txt", "b")
+	fs.Close()
+
+	cur := filepath.Join(c.DataDir, folderFile)
+	if err := os.WriteFile(cur, []byte("damaged"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	var recovery *docRecovery
+	if _, err := NewAMFS(c); !errors.As(err, &recovery) {
+		t.Fatalf("opened a damaged tree: %v", err)
+	}
+	if recovery.damaged != cur || recovery.lost == 0 {
+		t.Fatalf("recovery = %+v", recovery)
+	}
+	if data, _ := os.ReadFile(cur); string(data) != "damaged" {
+		t.Fatal("damaged generation was changed without -recover")
+	}
+
+	c.Recover = true
+	fs = openTestFS(t, c)
+	if _, err := fs.Stat("a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("a.txt was only in the damaged generation: %v", err)
+	}
+	fs.Close()
+	if matches, _ := filepath.Glob(cur + ".corrupt-*"); len(matches) != 1 {
+		t.Fatalf("damaged generation moved to %v", matches)
+	}
+
+	c.Recover = false
+	fs = openTestFS(t, c)
+	fs.Close()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -31,32 +32,60 @@ func main() {
 		os.Exit(1)
 	}
 
+	flag.StringVar(&cfg.Get(ctx).DataDir, "data", cfg.DataDir(ctx), "the directory to store the tree and file contents in")
+	flag.BoolVar(&cfg.Get(ctx).Recover, "recover", false, "start from the previous generation of the tree if the current one is damaged")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		if err := runCommand(ctx, flag.Arg(0), flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// open the tree before serving, so that a damaged data directory stops
+	// the daemon instead of being served
+	fs, err := NewAMFS(cfg.Get(ctx))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	listener, err := net.Listen("tcp", cfg.Listen(ctx))
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println("amfs listening on", listener.Addr())
 
-	syncListener, err := net.Listen("unix", cfg.UnixListen(ctx))
+	syncListener, err := listenUnix(cfg.UnixListen(ctx))
 	if err != nil {
 		panic(err)
 	}
 	fmt.Println("amfs listening on", cfg.UnixListen(ctx))
 
+	listeners := []net.Listener{listener, syncListener}
+	var peerListener net.Listener
+	if addr := cfg.Get(ctx).PeerListen; addr != "" {
+		if peerListener, err = net.Listen("tcp", addr); err != nil {
+			panic(err)
+		}
+		fmt.Println("amfs listening for peers on", peerListener.Addr())
+		listeners = append(listeners, peerListener)
+	}
+
 	parallel.Do(func(p *parallel.P) {
 		p.OnPanic = func(panick any) bool {
 			fmt.Println(panick)
 			debug.PrintStack()
-			shutdown(ctx, listener, syncListener)
+			shutdown(ctx, listeners...)
 			return true
 		}
 		for _, m := range cfg.Mounts(ctx) {
 			p.Go(func() { mount(ctx, m) })
 		}
 
-		p.Go(func() { handleInterrupt(ctx, listener, syncListener) })
-
-		fs := NewAMFS()
+		p.Go(func() { handleInterrupt(ctx, listeners...) })
 
 		p.Go(func() {
 			if err := serveSync(ctx, syncListener, fs); err != nil {
@@ -64,6 +93,20 @@ func main() {
 			}
 		})
 
+		p.Go(func() { fs.gcLoop(ctx) })
+
+		if peerListener != nil {
+			p.Go(func() { fs.servePeers(ctx, peerListener) })
+		}
+		for _, addr := range cfg.Get(ctx).Peers {
+			addr := addr
+			p.Go(func() { fs.dialPeer(ctx, addr) })
+		}
+		if peerListener != nil || len(cfg.Get(ctx).Peers) > 0 {
+			p.Go(func() { fs.prefetch(ctx) })
+		}
+		p.Go(func() { fs.cacheLoop(ctx) })
+
 		if err := nfs.Serve(listener, &handler{fs: fs}); err != nil {
 			panic(err)
 		}
@@ -125,17 +168,29 @@ func (h *handler) FSStat(ctx context.Context, f billy.Filesystem, s *nfs.FSStat)
 func (h *handler) ToHandle(f billy.Filesystem, s []string) []byte {
 	file, err := f.(*AMFS).getFileInfo(f.(*AMFS).Join(s...), None, 0)
 	if err != nil {
-		panic(err)
+		// the file was removed since the client looked it up; an empty handle
+		// is rejected by FromHandle, which reports it as stale.
+		fmt.Println("ToHandle", s, err)
+		return nil
 	}
+	// files in read-only views keep the view in their handle
 	handle := []byte(".amfs/=" + file.amid)
-	fmt.Println("ToHandle %#v", string(handle))
+	if file.amid == trashRoot || file.amid == pinsRoot {
+		handle = []byte(file.prefix)
+	} else if file.prefix != "" {
+		handle = []byte(file.prefix + "/=" + string(file.amid))
+		if file.version {
+			handle = append(handle, "/"+file.name...)
+		}
+	}
+	fmt.Printf("ToHandle %#v\n", string(handle))
 	return handle
 }
 
 // FromHandle handled by CachingHandler
 func (h *handler) FromHandle(handle []byte) (billy.Filesystem, []string, error) {
 	fmt.Printf("FromHandle: %#v %#v\n", handle, string(handle))
-	if !bytes.HasPrefix(handle, []byte(".amfs/=")) {
+	if !bytes.HasPrefix(handle, []byte(".amfs/")) {
 		return nil, nil, fmt.Errorf("invalid file handle: " + string(handle))
 	}
 	return h.fs, h.fs.(*AMFS).Split(string(handle)), nil
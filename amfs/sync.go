@@ -2,8 +2,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -11,12 +12,41 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/ConradIrwin/parallel"
 	"github.com/automerge/automerge-go"
 )
 
+// listenUnix listens on the socket at path so that only the user running
+// the daemon can connect, as the commands it accepts can change the tree.
+func listenUnix(path string) (net.Listener, error) {
+	// a socket left by a daemon that crashed stops the listen
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s: another amfs is listening", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// the socket is created with the umask's permissions, so don't leave
+	// it open to others even briefly
+	umask := syscall.Umask(0o077)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
 func serveSync(ctx context.Context, l net.Listener, fs *AMFS) error {
 	parallel.Do(func(p *parallel.P) {
 		p.OnPanic = func(pnk any) bool {
@@ -33,6 +63,14 @@ func serveSync(ctx context.Context, l net.Listener, fs *AMFS) error {
 			}
 
 			p.Go(func() {
+				// a bad connection should not take down the others
+				defer func() {
+					if pnk := recover(); pnk != nil {
+						fmt.Println("PANIC serving", c.RemoteAddr(), pnk)
+						debug.PrintStack()
+						c.Close()
+					}
+				}()
 				if err := serveConn(ctx, c, fs); err != nil {
 					fmt.Println("error serving: ", err)
 					c.Close()
@@ -47,6 +85,15 @@ func serveConn(ctx context.Context, c net.Conn, fs *AMFS) error {
 	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
 
 	syncers := map[AMID]*automerge.SyncState{}
+	// paths are what each file was opened as, for change messages
+	paths := map[AMID]string{}
+	defer func() {
+		fs.mergeable.mu.Lock()
+		for id := range syncers {
+			fs.releaseMergeable(id)
+		}
+		fs.mergeable.mu.Unlock()
+	}()
 
 	for {
 		line, err := rw.ReadString('\n')
@@ -65,89 +112,155 @@ func serveConn(ctx context.Context, c net.Conn, fs *AMFS) error {
 				rw.WriteString("ERROR " + line + ":" + err.Error() + "\n")
 			} else if i.IsDir() {
 				rw.WriteString("ERROR " + line + ": is directory\n")
+			} else if i.readOnly() {
+				// syncing would write to the live file (or recreate a
+				// deleted one) rather than the version that was opened
+				rw.WriteString("ERROR " + line + ": read-only file system\n")
 			} else {
 				if syncers[i.amid] == nil {
-					if i.file.Type == Blob {
-						content, err := os.ReadFile("fs/" + hex.EncodeToString(i.file.Heads[0]))
-						if err != nil {
-							fmt.Println("ERROR", err)
-						}
-
-						doc := automerge.New()
-						if err := Tx(doc).
-							Set("type").To("text").
-							Set("content").To(automerge.NewText(string(content))).
-							CommitOnly(); err != nil {
-							panic(err)
-						}
-						syncers[i.amid] = automerge.NewSyncState(doc)
-					} else {
-						saved, err := os.ReadFile("fs/" + string(i.amid))
-						if err != nil {
-							panic(err)
-						}
-						doc, err := automerge.Load(saved)
-						if err != nil {
-							panic(err)
-						}
-						syncers[i.amid] = automerge.NewSyncState(doc)
+					doc, err := fs.openMergeable(i)
+					if err != nil {
+						rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+						break
 					}
+					syncers[i.amid] = automerge.NewSyncState(doc)
 				}
+				paths[i.amid] = tail
 				bytes := syncers[i.amid].Doc.Save()
 				rw.WriteString("OPENED " + string(i.amid) + " " + fmt.Sprint(len(bytes)) + "\n")
 				rw.Write(bytes)
 				rw.WriteString("\n")
 			}
 		case "CLOSE":
+			if syncers[AMID(tail)] != nil {
+				fs.mergeable.mu.Lock()
+				fs.releaseMergeable(AMID(tail))
+				fs.mergeable.mu.Unlock()
+			}
 			delete(syncers, AMID(tail))
+			delete(paths, AMID(tail))
 			rw.WriteString("CLOSED " + tail + "\n")
 		case "SYNC":
 			id, size, _ := strings.Cut(tail, " ")
 
 			l, err := strconv.Atoi(size)
-			if err != nil || l > 1024*1024 {
-				rw.WriteString("ERROR " + line + ": invalid size")
+			if err != nil || l < 0 || l > 1024*1024 {
+				// without a size we can't find the next command, so give up
+				rw.WriteString("ERROR " + line + ": invalid size\n")
+				rw.Flush()
+				return fmt.Errorf("invalid size: %#v", size)
+			}
+
+			buf := make([]byte, l)
+			if _, err := io.ReadFull(rw, buf); err != nil {
+				return err
 			}
 
 			syncer, ok := syncers[AMID(id)]
 			if !ok {
-				rw.WriteString("ERROR " + line + ": not syncing")
+				rw.WriteString("ERROR " + line + ": not syncing\n")
+				break
 			}
 
 			if l > 0 {
-				buf := make([]byte, l)
-				if _, err := io.ReadFull(rw, buf); err != nil {
-					return err
+				if err := fs.receiveSync(AMID(id), paths[AMID(id)], syncer, buf); err != nil {
+					rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+					break
 				}
+			}
 
-				if err := syncer.ReceiveMessage(buf); err != nil {
-					rw.WriteString("ERROR " + line + ": " + err.Error())
-				}
-				val, err := automerge.As[string](syncer.Doc.Path("content").Get())
-				fmt.Printf("Document is now: %#v :: %#v", val, err)
+			msg, _ := syncer.GenerateMessage()
+			rw.WriteString("SYNC " + id + " " + fmt.Sprint(len(msg)) + "\n")
+			rw.Write(msg)
+			rw.WriteString("\n")
 
-				if err := os.WriteFile("fs/"+id, syncer.Doc.Save(), 0o644); err != nil {
-					fmt.Printf("ERROR: ", err)
-				}
+		case "FSCK":
+			report, err := fs.fsck(tail == "repair")
+			if err != nil {
+				rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+				break
+			}
+			for _, p := range report.Problems {
+				rw.WriteString("FSCK " + strings.ReplaceAll(p.String(), "\n", " ") + "\n")
+			}
+			rw.WriteString("FSCKED " + fmt.Sprint(report.unresolved()) + " " + report.String() + "\n")
 
-				err = Tx(fs.doc).
-					Set("files", id, "type").To(Mergeable).
-					Set("files", id, "modtime").To(time.Now()).
-					Set("files", id, "size").To(len(val)).
-					Inc("files", id, "modcount").
-					Set("files", id, "heads", 0).To(syncer.Doc.Heads()[0]).
-					Commit()
+		case "TRASH":
+			lines, err := fs.trashListing()
+			if err != nil {
+				rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+				break
+			}
+			for _, l := range lines {
+				rw.WriteString("TRASH " + l + "\n")
+			}
+			rw.WriteString("TRASHED " + fmt.Sprint(len(lines)) + "\n")
 
-				if err != nil {
-					panic(err)
-				}
+		case "RESTORE":
+			name, dest, _ := strings.Cut(tail, "\t")
+			path, err := fs.restore(name, dest)
+			if err != nil {
+				rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+				break
+			}
+			rw.WriteString("RESTORED " + path + "\n")
 
+		case "CONFLICTS":
+			lines, err := fs.conflictListing()
+			if err != nil {
+				rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+				break
+			}
+			for _, l := range lines {
+				rw.WriteString("CONFLICT " + l + "\n")
 			}
+			rw.WriteString("CONFLICTED " + fmt.Sprint(len(lines)) + "\n")
 
-			msg, _ := syncer.GenerateMessage()
-			rw.WriteString("SYNC " + id + " " + fmt.Sprint(len(msg)) + "\n")
-			rw.Write(msg)
-			rw.WriteString("\n")
+		case "RESOLVE":
+			path, err := fs.resolveConflict(tail)
+			if err != nil {
+				rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+				break
+			}
+			rw.WriteString("RESOLVED " + path + "\n")
+
+		case "LOG":
+			n, err := strconv.Atoi(tail)
+			if err != nil {
+				rw.WriteString("ERROR " + line + ": invalid count\n")
+				break
+			}
+			lines, err := fs.changeLog(n)
+			if err != nil {
+				rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+				break
+			}
+			for _, l := range lines {
+				rw.WriteString("CHANGE " + strings.ReplaceAll(l, "\n", " ") + "\n")
+			}
+			rw.WriteString("LOGGED " + fmt.Sprint(len(lines)) + "\n")
+
+		case "PIN", "UNPIN":
+			if err := fs.pin([]string{tail}, cmd == "UNPIN"); err != nil {
+				rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+				break
+			}
+			if cmd == "PIN" {
+				rw.WriteString("PINNED " + tail + "\n")
+			} else {
+				rw.WriteString("UNPINNED " + tail + "\n")
+			}
+
+		case "PINS":
+			lines, err := fs.pinListing()
+			if err != nil {
+				rw.WriteString("ERROR " + line + ": " + err.Error() + "\n")
+				break
+			}
+			for _, l := range lines {
+				rw.WriteString("PIN " + l + "\n")
+			}
+			rw.WriteString("PINS " + fmt.Sprint(len(lines)) + "\n")
 
 		case "":
 			// ignore empty lines
@@ -160,3 +273,143 @@ func serveConn(ctx context.Context, c net.Conn, fs *AMFS) error {
 		}
 	}
 }
+
+// mergeableDocs holds the mergeable docs that editors and peers are
+// syncing with, so that the changes from both end up in the same doc.
+type mergeableDocs struct {
+	mu   sync.Mutex
+	docs map[AMID]*automerge.Doc
+	// users counts the editors and peers syncing each doc, which is
+	// dropped from docs when the last of them stops
+	users map[AMID]int
+}
+
+// mergeableDoc returns the doc for the mergeable file, or an empty doc if
+// none is stored yet. Unless it is in use the doc is loaded from the blob
+// store, so changes to it must be saved there.
+// The caller must hold fs.mergeable.mu.
+func (fs *AMFS) mergeableDoc(id AMID) (*automerge.Doc, error) {
+	if doc, ok := fs.mergeable.docs[id]; ok {
+		return doc, nil
+	}
+	doc := automerge.New()
+	saved, err := fs.blobs.Get(string(id))
+	if err == nil {
+		doc, err = automerge.Load(saved)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// like the tree, changes made here are attributed to the identity
+	if err := doc.SetActorID(publicKey(fs.identity)); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// useMergeable keeps doc in memory as the file's doc until releaseMergeable
+// is called for each call to useMergeable.
+// The caller must hold fs.mergeable.mu.
+func (fs *AMFS) useMergeable(id AMID, doc *automerge.Doc) {
+	if fs.mergeable.docs == nil {
+		fs.mergeable.docs = map[AMID]*automerge.Doc{}
+		fs.mergeable.users = map[AMID]int{}
+	}
+	fs.mergeable.docs[id] = doc
+	fs.mergeable.users[id]++
+}
+
+// releaseMergeable drops the file's doc once nothing is syncing with it.
+// The caller must hold fs.mergeable.mu.
+func (fs *AMFS) releaseMergeable(id AMID) {
+	if fs.mergeable.users[id]--; fs.mergeable.users[id] <= 0 {
+		delete(fs.mergeable.users, id)
+		delete(fs.mergeable.docs, id)
+	}
+}
+
+// openMergeable returns the automerge doc for editing the file, which must
+// be released with releaseMergeable. Blobs are converted into a new text
+// doc with their current content.
+func (fs *AMFS) openMergeable(i *AMFileInfo) (*automerge.Doc, error) {
+	if i.file.Type == Mergeable {
+		if err := fs.fetchDoc(i.amid, i.file.Heads); err != nil {
+			return nil, err
+		}
+		fs.mergeable.mu.Lock()
+		defer fs.mergeable.mu.Unlock()
+		doc, err := fs.mergeableDoc(i.amid)
+		if err != nil {
+			return nil, err
+		}
+		fs.useMergeable(i.amid, doc)
+		return doc, nil
+	}
+
+	content := &bytes.Buffer{}
+	if err := fs.readContent(i, content); err != nil {
+		return nil, err
+	}
+
+	doc := automerge.New()
+	if err := doc.SetActorID(publicKey(fs.identity)); err != nil {
+		return nil, err
+	}
+	if err := Tx(doc).
+		Set("type").To("text").
+		Set("content").To(automerge.NewText(content.String())).
+		Describe("convert %s to text", i.name).
+		CommitOnly(); err != nil {
+		return nil, err
+	}
+
+	fs.mergeable.mu.Lock()
+	defer fs.mergeable.mu.Unlock()
+	fs.useMergeable(i.amid, doc)
+	return doc, nil
+}
+
+// receiveSync applies a sync message from the editor to the file's doc and
+// records the new version in the tree.
+func (fs *AMFS) receiveSync(id AMID, path string, syncer *automerge.SyncState, msg []byte) error {
+	fs.mergeable.mu.Lock()
+	if err := syncer.ReceiveMessage(msg); err != nil {
+		fs.mergeable.mu.Unlock()
+		return err
+	}
+	val, err := automerge.As[string](syncer.Doc.Path("content").Get())
+	fmt.Printf("Document is now: %#v :: %#v\n", val, err)
+	if err == nil {
+		err = fs.blobs.Put(string(id), syncer.Doc.Save())
+	}
+	fs.mergeable.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	heads := [][]byte{}
+	for _, h := range syncer.Doc.Heads() {
+		h := h
+		heads = append(heads, h[:])
+	}
+
+	return fs.update(func() error {
+		tx, err := fs.setHeads(fs.Tx(), id, heads)
+		if err != nil {
+			return err
+		}
+		tx = tx.
+			Set("files", id, "type").To(Mergeable).
+			Set("files", id, "modtime").To(time.Now()).
+			Set("files", id, "size").To(len(val)).
+			Inc("files", id, "modcount")
+		return fs.recordVersion(tx, id, &AMVersion{
+			ModTime: time.Now(),
+			Size:    int64(len(val)),
+			Type:    Mergeable,
+			Heads:   heads,
+		}).Describe("edit %s", path).Commit()
+	})
+}
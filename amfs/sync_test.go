@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/automerge/automerge-go"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "amfs.sock")
+	// left by a daemon that crashed
+	if err := os.WriteFile(path, nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("socket mode = %v", perm)
+	}
+
+	if _, err := listenUnix(path); err == nil {
+		t.Fatal("listened on a socket that is in use")
+	}
+}
+
+func TestReceiveSync(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	// not closed yet, so its heads are still empty
+	f, err := fs.Create("m.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var id AMID
+	fs.view(func() error {
+		info, err := fs.lookup("m.txt", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id = info.amid
+		return nil
+	})
+
+	// an editor with two concurrent changes
+	editor := automerge.New()
+	if err := Tx(editor).Set("type").To("text").Set("content").To(automerge.NewText("a")).CommitOnly(); err != nil {
+		t.Fatal(err)
+	}
+	other, err := editor.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := editor.Path("content").Text().Append("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := editor.Commit("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Path("content").Text().Append("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Commit("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := editor.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+
+	from, to := automerge.NewSyncState(editor), automerge.NewSyncState(automerge.New())
+	for {
+		msg, valid := from.GenerateMessage()
+		if !valid {
+			break
+		}
+		if err := fs.receiveSync(id, "m.txt", to, msg); err != nil {
+			t.Fatal(err)
+		}
+		if reply, valid := to.GenerateMessage(); valid {
+			if err := from.ReceiveMessage(reply); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	want := to.Doc.Heads()
+	if len(want) != 2 {
+		t.Fatalf("editor has %d heads", len(want))
+	}
+	fs.view(func() error {
+		heads, err := automerge.As[[][]byte](fs.doc.Path("files", id, "heads").Get())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(heads) != len(want) {
+			t.Fatalf("recorded %d heads of %d", len(heads), len(want))
+		}
+		for i, h := range want {
+			if !bytes.Equal(heads[i], h[:]) {
+				t.Fatalf("head %d is %x, not %x", i, heads[i], h[:])
+			}
+		}
+		return nil
+	})
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	writeTestFile(t, fs, "a.txt", "a")
+	if err := fs.Remove("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	trashed, err := fs.ReadDir(trashDir)
+	if err != nil || len(trashed) != 1 {
+		t.Fatalf("trash has %d entries: %v", len(trashed), err)
+	}
+	writeTestFile(t, fs, "b.txt", "b")
+	versions, err := fs.ReadDir(historyDir + "/b.txt")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("b.txt has %d versions: %v", len(versions), err)
+	}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveConn(ctx, s, fs)
+
+	r := bufio.NewReader(c)
+	for _, path := range []string{trashDir + "/" + trashed[0].Name(), historyDir + "/b.txt/" + versions[0].Name()} {
+		if _, err := c.Write([]byte("OPEN " + path + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "ERROR ") {
+			t.Fatalf("OPEN %s: %q", path, line)
+		}
+	}
+}
+
+func TestMergeableDocsReleased(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+	writeTestFile(t, fs, "a.txt", "a")
+	held := func() int {
+		fs.mergeable.mu.Lock()
+		defer fs.mergeable.mu.Unlock()
+		return len(fs.mergeable.docs)
+	}
+
+	c, s := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveConn(ctx, s, fs)
+	}()
+	r := bufio.NewReader(c)
+	// open sends cmd and reads the reply, skipping the doc sent with it
+	open := func(cmd string) string {
+		if _, err := c.Write([]byte(cmd + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "OPENED ") {
+			size, _ := strconv.Atoi(strings.Fields(line)[2])
+			if _, err := r.Discard(size + 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return line
+	}
+
+	line := open("OPEN a.txt")
+	if !strings.HasPrefix(line, "OPENED ") || held() != 1 {
+		t.Fatalf("OPEN a.txt: %q with %d docs", line, held())
+	}
+	id := strings.Fields(line)[1]
+	if line := open("CLOSE " + id); !strings.HasPrefix(line, "CLOSED ") || held() != 0 {
+		t.Fatalf("CLOSE: %q with %d docs", line, held())
+	}
+
+	// an editor that goes away without closing it
+	open("OPEN a.txt")
+	c.Close()
+	<-done
+	if n := held(); n != 0 {
+		t.Fatalf("%d docs held after the editor went away", n)
+	}
+
+	// and a peer syncing it
+	pc := &peerConn{peer: "test", ready: make(chan struct{}, 1), docs: map[AMID]*automerge.SyncState{}, files: fs.watchFiles()}
+	fs.mergeable.mu.Lock()
+	_, err := fs.docState(pc, AMID(id))
+	fs.mergeable.mu.Unlock()
+	if err != nil || held() != 1 {
+		t.Fatalf("%d docs held for the peer: %v", held(), err)
+	}
+	fs.disconnectPeer(pc)
+	if n := held(); n != 0 {
+		t.Fatalf("%d docs held after the peer went away", n)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/automerge/automerge-go"
+	"github.com/willscott/go-nfs-client/nfs"
+)
+
+// Remove moves files into the trash rather than forgetting about them. The
+// "trash" map of the tree records where each removed file was, who removed
+// it and when, keyed by AMID.
+//
+// The trash is shown in .amfs/trash, named by the time of removal and the
+// original name:
+//
+//	.amfs/trash/20230601T150405Z-main.go
+//
+// Files in the trash are read-only, but can be renamed out of it to
+// restore them (or restored to where they were with `amfs restore`), and
+// removing them from the trash purges them. Anything left in the trash for
+// longer than cfg.TrashRetention is purged by the garbage collector.
+const trashDir = ".amfs/trash"
+
+// trashRoot stands in for the AMID of .amfs/trash, which isn't a real
+// folder.
+const trashRoot = AMID("TRASH")
+
+// AMTrash records where a removed file was.
+type AMTrash struct {
+	Parent    AMID      `json:"parent"`
+	Name      string    `json:"name"`
+	Peer      string    `json:"peer"`
+	DeletedAt time.Time `json:"deleted"`
+}
+
+// trashEntry is a file in the trash, with its name in .amfs/trash.
+type trashEntry struct {
+	name  string
+	amid  AMID
+	trash *AMTrash
+	file  *AMFile
+}
+
+// trash adds the operations that move parent/name (which is amid) into the
+// trash to tx.
+// The caller must be inside fs.update.
+func (fs *AMFS) trash(tx *atx, parent AMID, name string, amid AMID) *atx {
+	return tx.
+		Set("trash", amid).To(&AMTrash{
+		Parent:    parent,
+		Name:      name,
+		Peer:      fs.doc.ActorID(),
+		DeletedAt: time.Now(),
+	}).
+		Set("files", amid, "loc").To(&AMLocation{
+		Parent:     trashRoot,
+		Name:       name,
+		MovedAt:    time.Now(),
+		FromParent: parent,
+		FromName:   name,
+		Peer:       fs.doc.ActorID(),
+	}).
+		Del("folders", parent, name).
+		Inc("files", parent, "modcount").
+		Set("files", parent, "modtime").To(time.Now())
+}
+
+// trashEntries returns the contents of the trash, oldest first.
+// The caller must be inside fs.view.
+func (fs *AMFS) trashEntries() ([]*trashEntry, error) {
+	trash, err := automerge.As[map[AMID]*AMTrash](fs.doc.Path("trash").Get())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := fs.tree(fs.doc)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*trashEntry{}
+	for amid, t := range trash {
+		// a file can be moved back into the tree on another peer
+		if t == nil || tree.parent[amid] != trashRoot {
+			continue
+		}
+		file, err := automerge.As[*AMFile](fs.doc.Path("files", amid).Get())
+		if err != nil {
+			return nil, err
+		}
+		if file != nil {
+			entries = append(entries, &trashEntry{amid: amid, trash: t, file: file})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].trash.DeletedAt.Equal(entries[j].trash.DeletedAt) {
+			return entries[i].trash.DeletedAt.Before(entries[j].trash.DeletedAt)
+		}
+		return entries[i].amid < entries[j].amid
+	})
+
+	seen := map[string]bool{}
+	for _, e := range entries {
+		e.name = e.trash.DeletedAt.UTC().Format("20060102T150405Z") + "-" + e.trash.Name
+		if seen[e.name] {
+			e.name += "~" + string(e.amid[:8])
+		}
+		seen[e.name] = true
+	}
+	return entries, nil
+}
+
+// lookupTrash finds the entry in the trash called name, which can also be
+// the AMID of the removed file.
+// The caller must be inside fs.view.
+func (fs *AMFS) lookupTrash(name string) (*trashEntry, error) {
+	entries, err := fs.trashEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.name == name || string(e.amid) == name {
+			return e, nil
+		}
+	}
+	return nil, pathError("lookup", trashDir+"/"+name, nfs.NFS3ErrNoEnt)
+}
+
+// trashInfo returns the info for .amfs/trash itself.
+// The caller must be inside fs.view.
+func (fs *AMFS) trashInfo() (*AMFileInfo, error) {
+	entries, err := fs.trashEntries()
+	if err != nil {
+		return nil, err
+	}
+	file := &AMFile{Permissions: os.ModeDir | 0o755, Type: Folder}
+	if n := len(entries); n > 0 {
+		file.ModTime = entries[n-1].trash.DeletedAt
+		file.ModCount = int64(n)
+	}
+	return &AMFileInfo{name: "trash", amid: trashRoot, file: file, prefix: trashDir}, nil
+}
+
+// restore moves an entry in the trash (by name or AMID) back to where it
+// was removed from, or to dest if it is set. It returns the restored path.
+func (fs *AMFS) restore(name, dest string) (string, error) {
+	err := fs.update(func() error {
+		e, err := fs.lookupTrash(name)
+		if err != nil {
+			return err
+		}
+
+		t, err := fs.tree(fs.doc)
+		if err != nil {
+			return err
+		}
+		var parent AMID
+		var target string
+		if dest != "" {
+			dir, base := filepath.Split(dest)
+			info, err := fs.lookup(dir, 0, 0)
+			if err != nil {
+				return err
+			}
+			if info.readOnly() {
+				return pathError("restore", dest, nfs.NFS3ErrROFS)
+			}
+			if !info.IsDir() {
+				return pathError("restore", dest, nfs.NFS3ErrNotDir)
+			}
+			parent, target = info.amid, base
+		} else {
+			parent, target = e.trash.Parent, e.trash.Name
+			p, ok := t.paths()[parent]
+			if !ok {
+				return fmt.Errorf("restore %s: %s is no longer a folder, choose where to restore it to", name, e.trash.Parent)
+			}
+			dest = p + "/" + target
+		}
+
+		if t.lookup(parent, target) != "" {
+			return pathError("restore", dest, nfs.NFS3ErrExist)
+		}
+
+		return fs.Tx().
+			Set("files", e.amid, "loc").To(&AMLocation{
+			Parent:     parent,
+			Name:       target,
+			MovedAt:    time.Now(),
+			FromParent: trashRoot,
+			FromName:   e.trash.Name,
+			Peer:       fs.doc.ActorID(),
+		}).
+			Set("folders", parent, target).To(e.amid).
+			Del("trash", e.amid).
+			Inc("files", parent, "modcount").
+			Set("files", parent, "modtime").To(time.Now()).
+			Describe("restore %s -> %s", name, dest).
+			Commit()
+	})
+	return dest, err
+}
+
+// trashListing describes the contents of the trash, one line per entry.
+func (fs *AMFS) trashListing() ([]string, error) {
+	lines := []string{}
+	err := fs.view(func() error {
+		entries, err := fs.trashEntries()
+		if err != nil {
+			return err
+		}
+		t, err := fs.tree(fs.doc)
+		if err != nil {
+			return err
+		}
+		paths := t.paths()
+		for _, e := range entries {
+			from, ok := paths[e.trash.Parent]
+			if !ok {
+				from = "?"
+			}
+			lines = append(lines, fmt.Sprintf("%s\t%s/%s\tremoved by %s", e.name, from, e.trash.Name, fs.actorName(e.trash.Peer)))
+		}
+		return nil
+	})
+	return lines, err
+}
+
+// purgeTrash purges everything that has been in the trash for longer than
+// cfg.TrashRetention, returning how many entries there were.
+func (fs *AMFS) purgeTrash() (int, error) {
+	if fs.cfg.TrashRetention <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-fs.cfg.TrashRetention)
+
+	n := 0
+	err := fs.update(func() error {
+		trash, err := automerge.As[map[AMID]*AMTrash](fs.doc.Path("trash").Get())
+		if err != nil {
+			return err
+		}
+		expired := []AMID{}
+		for amid, t := range trash {
+			if t == nil || t.DeletedAt.Before(cutoff) {
+				expired = append(expired, amid)
+			}
+		}
+		if len(expired) == 0 {
+			return nil
+		}
+		n = len(expired)
+		tx, err := fs.purge(fs.Tx(), expired)
+		if err != nil {
+			return err
+		}
+		return tx.Describe("purge %d expired from the trash", n).Commit()
+	})
+	return n, err
+}
+
+// purge adds the operations that forget about the files in the trash, and
+// everything inside them, to tx. Their content is then deleted by the
+// garbage collector.
+// The caller must be inside fs.update.
+func (fs *AMFS) purge(tx *atx, amids []AMID) (*atx, error) {
+	t, err := fs.tree(fs.doc)
+	if err != nil {
+		return nil, err
+	}
+	folders, err := automerge.As[map[AMID]map[string]AMID](fs.doc.Path("folders").Get())
+	if err != nil {
+		return nil, err
+	}
+	versions, err := automerge.As[map[AMID][]*AMVersion](fs.doc.Path("versions").Get())
+	if err != nil {
+		return nil, err
+	}
+
+	// only what is still in the trash, a file may have been restored on
+	// another peer
+	doomed := map[AMID]bool{}
+	var mark func(amid AMID)
+	mark = func(amid AMID) {
+		if doomed[amid] || amid == ROOT {
+			return
+		}
+		doomed[amid] = true
+		for _, child := range t.children[amid] {
+			mark(child)
+		}
+		for _, others := range t.others[amid] {
+			for _, child := range others {
+				mark(child)
+			}
+		}
+	}
+	for _, amid := range amids {
+		if t.parent[amid] == trashRoot {
+			mark(amid)
+		}
+	}
+
+	for _, amid := range amids {
+		tx = tx.Del("trash", amid)
+	}
+	for _, amid := range sortedAMIDs(doomed) {
+		tx = tx.Del("files", amid)
+		if _, ok := folders[amid]; ok {
+			tx = tx.Del("folders", amid)
+		}
+		if _, ok := versions[amid]; ok {
+			tx = tx.Del("versions", amid)
+		}
+	}
+	return tx, nil
+}
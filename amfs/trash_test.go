@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTrashRestore(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	if err := fs.MkdirAll("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, fs, "d/a.txt", "a")
+	writeTestFile(t, fs, "d/b.txt", "b")
+	for _, name := range []string{"d/a.txt", "d/b.txt"} {
+		if err := fs.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("%s is still there: %v", name, err)
+		}
+	}
+
+	entries, err := fs.ReadDir(trashDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d files in the trash", len(entries))
+	}
+	trashed := map[string]string{}
+	for _, e := range entries {
+		trashed[readTestFile(t, fs, trashDir+"/"+e.Name())] = e.Name()
+	}
+
+	// restored to where it was
+	path, err := fs.restore(trashed["a"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/d/a.txt" {
+		t.Fatalf("restored to %q", path)
+	}
+	if got := readTestFile(t, fs, "d/a.txt"); got != "a" {
+		t.Fatalf("d/a.txt = %q", got)
+	}
+
+	// restored by renaming it out of the trash
+	if err := fs.Rename(trashDir+"/"+trashed["b"], "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, fs, "c.txt"); got != "b" {
+		t.Fatalf("c.txt = %q", got)
+	}
+	if entries, _ := fs.ReadDir(trashDir); len(entries) != 0 {
+		t.Fatalf("%d files left in the trash", len(entries))
+	}
+}
+
+func TestTrashRestoreRemovedFolder(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	if err := fs.MkdirAll("d", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, fs, "d/a.txt", "a")
+	if err := fs.Remove("d/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("d"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := fs.ReadDir(trashDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		// the folder it was in is in the trash, so it can't go back there
+		if _, err := fs.restore(e.Name(), ""); err == nil {
+			t.Fatal("restored into a folder in the trash")
+		}
+		if _, err := fs.restore(e.Name(), "a.txt"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readTestFile(t, fs, "a.txt"); got != "a" {
+		t.Fatalf("a.txt = %q", got)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	writeTestFile(t, fs, "a.txt", "a")
+	if err := fs.Remove("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fs.ReadDir(trashDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("%d files in the trash: %v", len(entries), err)
+	}
+	if err := fs.Remove(trashDir + "/" + entries[0].Name()); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := fs.ReadDir(trashDir); len(entries) != 0 {
+		t.Fatalf("%d files left in the trash", len(entries))
+	}
+}
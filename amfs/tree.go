@@ -0,0 +1,815 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// Where a file is in the tree is recorded in its Location. The folders
+// maps are an index from names to AMIDs, and are only followed when they
+// agree with the Location of the file they point to.
+//
+// A Location is always written as a whole, so concurrent moves of the same
+// file resolve to one of them (whichever automerge picks) and a file never
+// ends up in two places. Concurrent moves of different folders can still
+// form a cycle (A into B on one peer, B into A on another); the move made
+// last (by MovedAt, then AMID) is undone by putting that folder back where
+// it was moved from. Every peer sees the same locations, so they all break
+// the cycle in the same way.
+//
+// Files created (or moved) to the same name concurrently all keep their
+// location, even though only one of them wins the name in the folders map.
+// The others are shown next to it as conflict copies:
+//
+//	notes (conflict from 3f2a9c1b 20230601T150405Z).txt
+//
+// named by the peer that wrote the location and when. A conflict copy is
+// resolved by renaming it, removing it, or with `amfs resolve`.
+
+// AMLocation is where a file is: its parent folder and name. Files in the
+// trash have trashRoot as their parent.
+type AMLocation struct {
+	Parent  AMID      `json:"parent"`
+	Name    string    `json:"name"`
+	MovedAt time.Time `json:"moved"`
+	// FromParent and FromName are where the file was before it was moved.
+	FromParent AMID   `json:"fromparent,omitempty"`
+	FromName   string `json:"fromname,omitempty"`
+	// Peer is the actor ID of the peer that moved the file here.
+	Peer string `json:"peer,omitempty"`
+}
+
+// tree is the folder structure of a tree document, as resolved from the
+// locations of its files.
+type tree struct {
+	parent map[AMID]AMID
+	name   map[AMID]string
+	// children maps each folder to the files in it by name
+	children map[AMID]map[string]AMID
+	// conflicts maps each conflict copy in children to the file that has
+	// its name
+	conflicts map[AMID]AMID
+	// others lists files whose name (and conflict name) is taken by a file
+	// in children
+	others map[AMID]map[string][]AMID
+
+	// files, folders and trash are what the tree is resolved from
+	files   map[AMID]*AMFile
+	folders map[AMID]map[string]AMID
+	trash   map[AMID]*AMTrash
+	// located maps each folder to the files whose Location is in it, and
+	// indexed maps each file to the entries in the folders maps for it
+	located map[AMID]map[AMID]bool
+	indexed map[AMID]map[treeEntry]bool
+	// raw is where each file is before cycles are broken, and locs after
+	raw  map[AMID]*AMLocation
+	locs map[AMID]*AMLocation
+	// members maps each folder to the files in locs that are in it
+	members map[AMID]map[AMID]bool
+	// broken is set if there were cycles to break
+	broken bool
+}
+
+// treeEntry is an entry in the folders maps.
+type treeEntry struct {
+	parent AMID
+	name   string
+}
+
+// treeCacheSize is enough for a few historical trees.
+const treeCacheSize = 8
+
+// treeCache keeps resolved historical trees by the heads of the document
+// they were resolved from.
+type treeCache struct {
+	mu    sync.Mutex
+	trees map[string]*tree
+	order []string
+}
+
+// liveTree is the resolved tree of fs.doc. It is kept up to date as
+// transactions are committed (see treeCommitted), so that a write only
+// resolves the files it touched again. Changes merged from peers aren't
+// followed like that, the tree is resolved again after them.
+type liveTree struct {
+	mu    sync.Mutex
+	heads string
+	tree  *tree
+	// watches are told which files change, see watchFiles
+	watches map[*fileWatch]bool
+}
+
+// fileWatch collects the files whose type, heads or location have changed
+// since it was last read.
+type fileWatch struct {
+	changed map[AMID]bool
+	// all is set until the watch has been read for the first time
+	all bool
+}
+
+// tree returns the resolved folder structure of doc, which is either the
+// tree document or a historical version of it.
+// The caller must be inside fs.view.
+func (fs *AMFS) tree(doc *automerge.Doc) (*tree, error) {
+	if doc == fs.doc {
+		l := &fs.live
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return fs.currentTree()
+	}
+
+	k := headsKey(doc)
+	c := &fs.trees
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t := c.trees[k]; t != nil {
+		return t, nil
+	}
+
+	t, err := resolveTree(doc)
+	if err != nil {
+		return nil, err
+	}
+	if c.trees == nil {
+		c.trees = map[string]*tree{}
+	}
+	if len(c.order) >= treeCacheSize {
+		delete(c.trees, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.trees[k] = t
+	c.order = append(c.order, k)
+	return t, nil
+}
+
+// currentTree returns the resolved tree of fs.doc, resolving it again if
+// the doc has changed in ways it hasn't followed.
+// The caller must hold fs.live.mu.
+func (fs *AMFS) currentTree() (*tree, error) {
+	l := &fs.live
+	k := headsKey(fs.doc)
+	if l.tree != nil && l.heads == k {
+		return l.tree, nil
+	}
+	t, err := resolveTree(fs.doc)
+	if err != nil {
+		return nil, err
+	}
+	if l.tree != nil {
+		l.notify(changedFiles(l.tree, t))
+	}
+	l.tree, l.heads = t, k
+	return t, nil
+}
+
+// treeCommitted updates the resolved tree of fs.doc with the operations of
+// a transaction that was just committed on top of before.
+func (fs *AMFS) treeCommitted(before string, ops []atxOp) {
+	l := &fs.live
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tree == nil || l.heads != before {
+		return
+	}
+	changed, err := l.tree.update(fs.doc, ops)
+	l.notify(changed)
+	if err != nil {
+		// resolve it again when it's next needed, and tell the watches
+		// about whatever else has changed then
+		fmt.Println("ERROR: tree:", err)
+		l.heads = ""
+		return
+	}
+	l.heads = headsKey(fs.doc)
+}
+
+// watchFiles returns a watch that collects the files of fs.doc that
+// change. It starts with all of them.
+func (fs *AMFS) watchFiles() *fileWatch {
+	fs.live.mu.Lock()
+	defer fs.live.mu.Unlock()
+	if fs.live.watches == nil {
+		fs.live.watches = map[*fileWatch]bool{}
+	}
+	w := &fileWatch{changed: map[AMID]bool{}, all: true}
+	fs.live.watches[w] = true
+	return w
+}
+
+// unwatchFiles stops w collecting changes.
+func (fs *AMFS) unwatchFiles(w *fileWatch) {
+	fs.live.mu.Lock()
+	defer fs.live.mu.Unlock()
+	delete(fs.live.watches, w)
+}
+
+// changedFiles returns the files of fs.doc that have changed since w was
+// last read, and the resolved tree they are in.
+// The caller must be inside fs.view.
+func (fs *AMFS) changedFiles(w *fileWatch) (*tree, map[AMID]bool, error) {
+	fs.live.mu.Lock()
+	defer fs.live.mu.Unlock()
+	t, err := fs.currentTree()
+	if err != nil {
+		return nil, nil, err
+	}
+	changed := w.changed
+	if w.all {
+		changed = map[AMID]bool{}
+		for amid := range t.files {
+			changed[amid] = true
+		}
+	}
+	w.changed, w.all = map[AMID]bool{}, false
+	return t, changed, nil
+}
+
+// notify tells the watches about changed files.
+func (l *liveTree) notify(changed map[AMID]bool) {
+	for w := range l.watches {
+		for amid := range changed {
+			w.changed[amid] = true
+		}
+	}
+}
+
+// headsKey identifies the version of doc by its heads.
+func headsKey(doc *automerge.Doc) string {
+	key := []string{}
+	for _, h := range doc.Heads() {
+		key = append(key, h.String())
+	}
+	return strings.Join(key, ",")
+}
+
+// resolveTree works out where every file in doc is.
+func resolveTree(doc *automerge.Doc) (*tree, error) {
+	t := &tree{
+		parent:    map[AMID]AMID{},
+		name:      map[AMID]string{},
+		children:  map[AMID]map[string]AMID{},
+		conflicts: map[AMID]AMID{},
+		others:    map[AMID]map[string][]AMID{},
+		located:   map[AMID]map[AMID]bool{},
+		indexed:   map[AMID]map[treeEntry]bool{},
+		raw:       map[AMID]*AMLocation{},
+		locs:      map[AMID]*AMLocation{},
+		members:   map[AMID]map[AMID]bool{},
+	}
+	var err error
+	if t.files, err = automerge.As[map[AMID]*AMFile](doc.Path("files").Get()); err != nil {
+		return nil, err
+	}
+	if t.folders, err = automerge.As[map[AMID]map[string]AMID](doc.Path("folders").Get()); err != nil {
+		return nil, err
+	}
+	if t.trash, err = automerge.As[map[AMID]*AMTrash](doc.Path("trash").Get()); err != nil {
+		return nil, err
+	}
+	if t.files == nil {
+		t.files = map[AMID]*AMFile{}
+	}
+	if t.folders == nil {
+		t.folders = map[AMID]map[string]AMID{}
+	}
+	if t.trash == nil {
+		t.trash = map[AMID]*AMTrash{}
+	}
+
+	for parent, names := range t.folders {
+		for name, child := range names {
+			t.index(treeEntry{parent, name}, child)
+		}
+	}
+	for amid, f := range t.files {
+		if f == nil {
+			delete(t.files, amid)
+		} else if f.Location != nil {
+			t.locate(amid, f.Location.Parent)
+		}
+	}
+	for amid := range t.files {
+		if l := t.rawLocation(amid); l != nil {
+			t.raw[amid] = l
+		}
+	}
+
+	dirty := map[AMID]bool{}
+	for amid, l := range t.breakCycles() {
+		t.place(amid, l, dirty)
+	}
+	for folder := range dirty {
+		t.resolveFolder(folder)
+	}
+	return t, nil
+}
+
+// atxPath converts the segments of an operation's path as automerge.Path
+// does, so that AMIDs and names compare as strings.
+func atxPath(path []any) []any {
+	ret := make([]any, len(path))
+	for i, v := range path {
+		rv := reflect.ValueOf(v)
+		if rv.CanInt() {
+			ret[i] = int(rv.Int())
+		} else {
+			ret[i] = rv.String()
+		}
+	}
+	return ret
+}
+
+// update brings the tree up to date with ops, which have just been
+// committed to doc, and returns the files whose type, heads or location
+// changed. Only the files, folders and trash entries that ops wrote to are
+// read from doc, and only the folders whose files moved are resolved again.
+func (t *tree) update(doc *automerge.Doc, ops []atxOp) (map[AMID]bool, error) {
+	changed := map[AMID]bool{}
+	files := map[AMID]bool{}
+	trash := map[AMID]bool{}
+	folders := map[AMID]bool{}
+	entries := map[treeEntry]bool{}
+	for _, op := range ops {
+		path := atxPath(op.path)
+		if len(path) == 0 {
+			return changed, fmt.Errorf("%s of the whole document", op.name)
+		}
+		key := fmt.Sprint(path[0])
+		if key != "files" && key != "folders" && key != "trash" {
+			continue
+		}
+		if len(path) == 1 {
+			return changed, fmt.Errorf("%s of %s", op.name, key)
+		}
+		amid := AMID(fmt.Sprint(path[1]))
+		switch {
+		case key == "files":
+			files[amid] = true
+		case key == "trash":
+			trash[amid] = true
+		case len(path) == 2:
+			folders[amid] = true
+		default:
+			entries[treeEntry{amid, fmt.Sprint(path[2])}] = true
+		}
+	}
+
+	// affected are the files that might have moved, and dirty the folders
+	// whose children need resolving again
+	affected := map[AMID]bool{}
+	dirty := map[AMID]bool{}
+	refolded := []AMID{}
+	for amid := range files {
+		f, err := automerge.As[*AMFile](doc.Path("files", amid).Get())
+		if err != nil {
+			return changed, err
+		}
+		old := t.files[amid]
+		if !sameFile(old, f) {
+			changed[amid] = true
+		}
+		if old != nil && old.Location != nil {
+			t.unlocate(amid, old.Location.Parent)
+		}
+		if f != nil && f.Location != nil {
+			t.locate(amid, f.Location.Parent)
+		}
+		if t.isFolder(amid) != (f != nil && f.Type == Folder) {
+			refolded = append(refolded, amid)
+		}
+		if f == nil {
+			delete(t.files, amid)
+		} else {
+			t.files[amid] = f
+		}
+		affected[amid] = true
+	}
+
+	for parent := range folders {
+		names, err := automerge.As[map[string]AMID](doc.Path("folders", parent).Get())
+		if err != nil {
+			return changed, err
+		}
+		for name, child := range t.folders[parent] {
+			t.unindex(treeEntry{parent, name}, child)
+			affected[child] = true
+		}
+		delete(t.folders, parent)
+		for name, child := range names {
+			t.setEntry(treeEntry{parent, name}, child)
+			affected[child] = true
+		}
+		dirty[parent] = true
+	}
+	for e := range entries {
+		if folders[e.parent] {
+			continue
+		}
+		child, err := automerge.As[AMID](doc.Path("folders", e.parent, e.name).Get())
+		if err != nil {
+			return changed, err
+		}
+		if old, ok := t.folders[e.parent][e.name]; ok {
+			t.unindex(e, old)
+			delete(t.folders[e.parent], e.name)
+			affected[old] = true
+		}
+		if child != "" {
+			t.setEntry(e, child)
+			affected[child] = true
+		}
+		dirty[e.parent] = true
+	}
+
+	for amid := range trash {
+		e, err := automerge.As[*AMTrash](doc.Path("trash", amid).Get())
+		if err != nil {
+			return changed, err
+		}
+		if e == nil {
+			delete(t.trash, amid)
+		} else {
+			t.trash[amid] = e
+		}
+		affected[amid] = true
+	}
+
+	// files in (or indexed by) a folder that was created or removed
+	for _, folder := range refolded {
+		for amid := range t.located[folder] {
+			affected[amid] = true
+		}
+		for _, child := range t.folders[folder] {
+			affected[child] = true
+		}
+	}
+
+	moved := []AMID{}
+	for amid := range affected {
+		l := t.rawLocation(amid)
+		if sameLocation(l, t.raw[amid]) {
+			continue
+		}
+		if l == nil {
+			delete(t.raw, amid)
+		} else {
+			t.raw[amid] = l
+		}
+		moved = append(moved, amid)
+	}
+
+	// without cycles, a file is where its raw location says; a new cycle
+	// must go through one of the files that moved
+	locs := t.raw
+	if t.broken || t.cyclic(moved) {
+		locs = t.breakCycles()
+		moved = moved[:0]
+		for amid := range t.locs {
+			moved = append(moved, amid)
+		}
+		for amid := range locs {
+			moved = append(moved, amid)
+		}
+	}
+	for _, amid := range moved {
+		if l := locs[amid]; !sameLocation(l, t.locs[amid]) {
+			t.place(amid, l, dirty)
+			changed[amid] = true
+		}
+	}
+	for folder := range dirty {
+		t.resolveFolder(folder)
+	}
+	return changed, nil
+}
+
+func (t *tree) isFolder(amid AMID) bool {
+	return t.files[amid] != nil && t.files[amid].Type == Folder
+}
+
+func (t *tree) locate(amid AMID, parent AMID) {
+	if t.located[parent] == nil {
+		t.located[parent] = map[AMID]bool{}
+	}
+	t.located[parent][amid] = true
+}
+
+func (t *tree) unlocate(amid AMID, parent AMID) {
+	delete(t.located[parent], amid)
+	if len(t.located[parent]) == 0 {
+		delete(t.located, parent)
+	}
+}
+
+// setEntry adds an entry to the folders maps.
+func (t *tree) setEntry(e treeEntry, child AMID) {
+	if t.folders[e.parent] == nil {
+		t.folders[e.parent] = map[string]AMID{}
+	}
+	t.folders[e.parent][e.name] = child
+	t.index(e, child)
+}
+
+func (t *tree) index(e treeEntry, child AMID) {
+	if t.indexed[child] == nil {
+		t.indexed[child] = map[treeEntry]bool{}
+	}
+	t.indexed[child][e] = true
+}
+
+func (t *tree) unindex(e treeEntry, child AMID) {
+	delete(t.indexed[child], e)
+	if len(t.indexed[child]) == 0 {
+		delete(t.indexed, child)
+	}
+}
+
+// rawLocation returns where amid is, before cycles are broken, or nil if
+// it is nowhere.
+func (t *tree) rawLocation(amid AMID) *AMLocation {
+	f := t.files[amid]
+	if f == nil || amid == ROOT {
+		return nil
+	}
+	if l := f.Location; l != nil && (l.Parent == trashRoot || t.isFolder(l.Parent)) {
+		return l
+	}
+
+	// files written before locations were recorded are found through the
+	// folders maps (or the trash)
+	var first *treeEntry
+	for e := range t.indexed[amid] {
+		if !t.isFolder(e.parent) {
+			continue
+		}
+		if first == nil || e.parent < first.parent || e.parent == first.parent && e.name < first.name {
+			e := e
+			first = &e
+		}
+	}
+	if first != nil {
+		return &AMLocation{Parent: first.parent, Name: first.name}
+	}
+	if e := t.trash[amid]; e != nil {
+		return &AMLocation{Parent: trashRoot, Name: e.Name}
+	}
+	return nil
+}
+
+// cyclic reports whether any of the files in moved is now inside itself.
+// It assumes there were no cycles before they moved.
+func (t *tree) cyclic(moved []AMID) bool {
+	for _, amid := range moved {
+		l := t.raw[amid]
+		for i := 0; l != nil && i <= len(t.raw); i++ {
+			if l.Parent == amid {
+				return true
+			}
+			l = t.raw[l.Parent]
+		}
+	}
+	return false
+}
+
+// breakCycles returns the raw locations with cycles broken, undoing the
+// latest move in each.
+func (t *tree) breakCycles() map[AMID]*AMLocation {
+	locs := map[AMID]*AMLocation{}
+	for amid, l := range t.raw {
+		locs[amid] = l
+	}
+	t.broken = false
+	undone := map[AMID]bool{}
+	for {
+		cycle := findCycle(locs)
+		if cycle == nil {
+			break
+		}
+		t.broken = true
+		last := cycle[0]
+		for _, amid := range cycle[1:] {
+			l, m := locs[amid], locs[last]
+			if l.MovedAt.After(m.MovedAt) || l.MovedAt.Equal(m.MovedAt) && amid > last {
+				last = amid
+			}
+		}
+		l := locs[last]
+		if undone[last] || l.FromParent == "" || !(l.FromParent == trashRoot || t.isFolder(l.FromParent)) {
+			// nowhere to put it back, fsck will move it to lost+found
+			delete(locs, last)
+			continue
+		}
+		undone[last] = true
+		locs[last] = &AMLocation{Parent: l.FromParent, Name: l.FromName, MovedAt: l.MovedAt}
+	}
+	return locs
+}
+
+// place puts amid at l (or nowhere if l is nil), and marks the folders it
+// moved between as dirty.
+func (t *tree) place(amid AMID, l *AMLocation, dirty map[AMID]bool) {
+	if old := t.locs[amid]; old != nil {
+		delete(t.members[old.Parent], amid)
+		if len(t.members[old.Parent]) == 0 {
+			delete(t.members, old.Parent)
+		}
+		dirty[old.Parent] = true
+	}
+	if l == nil {
+		delete(t.locs, amid)
+		delete(t.parent, amid)
+		delete(t.name, amid)
+		return
+	}
+	t.locs[amid] = l
+	t.parent[amid] = l.Parent
+	t.name[amid] = l.Name
+	if t.members[l.Parent] == nil {
+		t.members[l.Parent] = map[AMID]bool{}
+	}
+	t.members[l.Parent][amid] = true
+	dirty[l.Parent] = true
+}
+
+// resolveFolder works out the names of the files in folder.
+func (t *tree) resolveFolder(folder AMID) {
+	for _, amid := range t.children[folder] {
+		delete(t.conflicts, amid)
+	}
+	delete(t.children, folder)
+	delete(t.others, folder)
+	if len(t.members[folder]) == 0 {
+		return
+	}
+
+	children := map[string]AMID{}
+	losers := []AMID{}
+	for _, amid := range sortedAMIDs(t.members[folder]) {
+		l := t.locs[amid]
+		// if two files have the same name, the one in the folders map
+		// keeps it
+		existing := children[l.Name]
+		if existing == "" || t.folders[folder][l.Name] == amid {
+			children[l.Name] = amid
+			if existing == "" {
+				continue
+			}
+			amid = existing
+		}
+		losers = append(losers, amid)
+	}
+	t.children[folder] = children
+
+	// the rest become conflict copies, after every real name is taken
+	sort.Slice(losers, func(i, j int) bool { return losers[i] < losers[j] })
+	for _, amid := range losers {
+		l := t.locs[amid]
+		// the trash names its entries itself, see trashEntries
+		if name := conflictName(l); folder != trashRoot && children[name] == "" {
+			children[name] = amid
+			t.conflicts[amid] = children[l.Name]
+			continue
+		}
+		if t.others[folder] == nil {
+			t.others[folder] = map[string][]AMID{}
+		}
+		t.others[folder][l.Name] = append(t.others[folder][l.Name], amid)
+	}
+}
+
+// changedFiles returns the files whose type, heads or location differ
+// between two resolved trees.
+func changedFiles(old, new *tree) map[AMID]bool {
+	changed := map[AMID]bool{}
+	for amid, f := range new.files {
+		if !sameFile(old.files[amid], f) || !sameLocation(old.locs[amid], new.locs[amid]) {
+			changed[amid] = true
+		}
+	}
+	for amid := range old.files {
+		if new.files[amid] == nil {
+			changed[amid] = true
+		}
+	}
+	return changed
+}
+
+// sameFile reports whether a and b have the same type, heads and location.
+func sameFile(a, b *AMFile) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Type != b.Type || len(a.Heads) != len(b.Heads) || !sameLocation(a.Location, b.Location) {
+		return false
+	}
+	for i := range a.Heads {
+		if !bytes.Equal(a.Heads[i], b.Heads[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameLocation(a, b *AMLocation) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Parent == b.Parent && a.Name == b.Name && a.MovedAt.Equal(b.MovedAt) &&
+		a.FromParent == b.FromParent && a.FromName == b.FromName && a.Peer == b.Peer
+}
+
+// conflictName returns the name a file at l is shown with when another file
+// has taken its name.
+func conflictName(l *AMLocation) string {
+	peer := l.Peer
+	if len(peer) > 8 {
+		peer = peer[:8]
+	}
+	if peer == "" {
+		peer = "unknown peer"
+	}
+	ext := filepath.Ext(l.Name)
+	if ext == l.Name {
+		ext = ""
+	}
+	return fmt.Sprintf("%s (conflict from %s %s)%s",
+		strings.TrimSuffix(l.Name, ext), peer, l.MovedAt.UTC().Format("20060102T150405Z"), ext)
+}
+
+// findCycle returns the files in a cycle of locations, if there is one.
+func findCycle(locs map[AMID]*AMLocation) []AMID {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[AMID]int{}
+	for _, start := range sortedAMIDs(locs) {
+		path := []AMID{}
+		for amid := start; ; {
+			if state[amid] == visiting {
+				for i, p := range path {
+					if p == amid {
+						return path[i:]
+					}
+				}
+			}
+			l := locs[amid]
+			if state[amid] == done || l == nil {
+				break
+			}
+			state[amid] = visiting
+			path = append(path, amid)
+			amid = l.Parent
+		}
+		for _, p := range path {
+			state[p] = done
+		}
+	}
+	return nil
+}
+
+// lookup returns the file called name in folder, or "" if there isn't one.
+func (t *tree) lookup(folder AMID, name string) AMID {
+	return t.children[folder][name]
+}
+
+// contains reports whether amid is folder or is inside it.
+func (t *tree) contains(folder AMID, amid AMID) bool {
+	for i := 0; i <= len(t.parent); i++ {
+		if amid == folder {
+			return true
+		}
+		parent, ok := t.parent[amid]
+		if !ok {
+			return false
+		}
+		amid = parent
+	}
+	return false
+}
+
+// paths returns the path of everything reachable from ROOT.
+func (t *tree) paths() map[AMID]string {
+	paths := map[AMID]string{ROOT: ""}
+	queue := []AMID{ROOT}
+	for len(queue) > 0 {
+		folder := queue[0]
+		queue = queue[1:]
+		for name, child := range t.children[folder] {
+			if _, ok := paths[child]; ok {
+				continue
+			}
+			paths[child] = paths[folder] + "/" + name
+			queue = append(queue, child)
+		}
+	}
+	return paths
+}
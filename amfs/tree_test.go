@@ -0,0 +1,179 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+var testMoveTime = time.Date(2023, 6, 1, 15, 4, 5, 0, time.UTC)
+
+// testTreeDoc returns a tree document with folders a and b in ROOT.
+func testTreeDoc(t *testing.T) *automerge.Doc {
+	doc := automerge.New()
+	tx := Tx(doc).
+		Set("files", ROOT).To(&AMFile{Type: Folder}).
+		Set("folders", ROOT).To(automerge.NewMap())
+	for _, id := range []AMID{"a", "b"} {
+		testCreate(tx, id, Folder, ROOT, string(id))
+	}
+	if err := tx.CommitOnly(); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func testCreate(tx *atx, id AMID, typ AMType, parent AMID, name string) *atx {
+	tx.Set("files", id).To(&AMFile{Type: typ, Location: &AMLocation{Parent: parent, Name: name, MovedAt: testMoveTime, Peer: "test"}}).
+		Set("folders", parent, name).To(id)
+	if typ == Folder {
+		tx.Set("folders", id).To(automerge.NewMap())
+	}
+	return tx
+}
+
+func testMove(tx *atx, id AMID, from AMID, to AMID, name string, at int) *atx {
+	return tx.Set("files", id, "loc").To(&AMLocation{
+		Parent:     to,
+		Name:       name,
+		MovedAt:    testMoveTime.Add(time.Duration(at) * time.Second),
+		FromParent: from,
+		FromName:   string(id),
+		Peer:       "test",
+	}).
+		Del("folders", from, string(id)).
+		Set("folders", to, name).To(id)
+}
+
+func TestTreeCycle(t *testing.T) {
+	doc := testTreeDoc(t)
+	other, err := doc.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a into b, and concurrently (but later) b into a
+	if err := testMove(Tx(doc), "a", ROOT, "b", "a", 1).CommitOnly(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testMove(Tx(other), "b", ROOT, "a", "b", 2).CommitOnly(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doc.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := resolveTree(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.parent["a"] != "b" || tr.parent["b"] != ROOT {
+		t.Fatalf("a is in %q and b in %q", tr.parent["a"], tr.parent["b"])
+	}
+	if tr.lookup(ROOT, "b") != "b" || tr.lookup("b", "a") != "a" {
+		t.Fatalf("children %v", tr.children)
+	}
+}
+
+// TestTreeUpdate checks that updating a tree with the operations of each
+// transaction gives the same tree as resolving it again.
+func TestTreeUpdate(t *testing.T) {
+	doc := testTreeDoc(t)
+	tr, err := resolveTree(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name  string
+		tx    func(tx *atx) *atx
+		check func(tr *tree) bool
+	}{
+		{"create a/x", func(tx *atx) *atx {
+			return testCreate(tx, "f1", Blob, "a", "x")
+		}, func(tr *tree) bool { return tr.lookup("a", "x") == "f1" }},
+		{"mkdir c", func(tx *atx) *atx {
+			return testCreate(tx, "c", Folder, ROOT, "c")
+		}, nil},
+		{"move a/x to c/x", func(tx *atx) *atx {
+			return testMove(tx, "f1", "a", "c", "x", 1).Del("folders", "a", "x")
+		}, func(tr *tree) bool { return tr.lookup("c", "x") == "f1" && len(tr.children["a"]) == 0 }},
+		{"move a into b", func(tx *atx) *atx {
+			return testMove(tx, "a", ROOT, "b", "a", 2)
+		}, func(tr *tree) bool { return tr.parent["a"] == "b" }},
+		{"locate f2 at c/x", func(tx *atx) *atx {
+			return tx.Set("files", "f2").To(&AMFile{Type: Blob, Location: &AMLocation{Parent: "c", Name: "x", MovedAt: testMoveTime, Peer: "test"}})
+		}, func(tr *tree) bool { return tr.conflicts["f2"] == "f1" }},
+		{"remove c/x", func(tx *atx) *atx {
+			return tx.Del("files", "f1").Del("folders", "c", "x")
+		}, func(tr *tree) bool { return tr.lookup("c", "x") == "f2" && len(tr.conflicts) == 0 }},
+		{"move b into a", func(tx *atx) *atx {
+			return testMove(tx, "b", ROOT, "a", "b", 3)
+		}, func(tr *tree) bool { return tr.parent["a"] == "b" && tr.parent["b"] == ROOT }},
+		{"move a to ROOT", func(tx *atx) *atx {
+			return testMove(tx, "a", "b", ROOT, "a", 4)
+		}, func(tr *tree) bool { return tr.parent["a"] == ROOT && tr.parent["b"] == "a" }},
+		{"rmdir c", func(tx *atx) *atx {
+			return tx.Del("files", "c").Del("folders", "c").Del("folders", ROOT, "c")
+		}, func(tr *tree) bool { _, ok := tr.parent["f2"]; return !ok }},
+		{"trash a", func(tx *atx) *atx {
+			return tx.Set("trash", "a").To(&AMTrash{Parent: ROOT, Name: "a"}).
+				Set("files", "a", "loc").To(&AMLocation{Parent: trashRoot, Name: "a"}).
+				Del("folders", ROOT, "a")
+		}, func(tr *tree) bool { return tr.parent["a"] == trashRoot && tr.parent["b"] == "a" }},
+	}
+
+	for _, step := range steps {
+		tx := step.tx(Tx(doc))
+		if err := tx.CommitOnly(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if _, err := tr.update(doc, tx.ops); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		want, err := resolveTree(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tr.parent, want.parent) || !reflect.DeepEqual(tr.name, want.name) ||
+			!reflect.DeepEqual(tr.children, want.children) || !reflect.DeepEqual(tr.conflicts, want.conflicts) ||
+			!reflect.DeepEqual(tr.others, want.others) {
+			t.Fatalf("%s: updated to %v, resolved to %v", step.name, tr.children, want.children)
+		}
+		if step.check != nil && !step.check(tr) {
+			t.Fatalf("%s: unexpected tree %v", step.name, tr.children)
+		}
+	}
+}
+
+func TestTreeWatch(t *testing.T) {
+	fs := openTestFS(t, testConfig(t))
+	defer fs.Close()
+
+	w := fs.watchFiles()
+	defer fs.unwatchFiles(w)
+	fs.view(func() error {
+		_, changed, err := fs.changedFiles(w)
+		if err != nil || !changed[ROOT] {
+			t.Fatalf("first read has %v, %v", changed, err)
+		}
+		return nil
+	})
+
+	writeTestFile(t, fs, "a.txt", "a")
+	fs.view(func() error {
+		tr, changed, err := fs.changedFiles(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amid := tr.lookup(ROOT, "a.txt")
+		if amid == "" || !changed[amid] {
+			t.Fatalf("a.txt (%s) not in %v", amid, changed)
+		}
+		if _, changed, _ = fs.changedFiles(w); len(changed) != 0 {
+			t.Fatalf("%v changed again", changed)
+		}
+		return nil
+	})
+}
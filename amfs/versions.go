@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/automerge/automerge-go"
+	"github.com/willscott/go-nfs-client/nfs"
+)
+
+// .amfs/history mirrors the tree, except that each file is shown as a
+// read-only directory of its past versions:
+//
+//	.amfs/history/src/main.go/20230601T150405Z-3f2a9c1b7e04.go
+//
+// Versions are named by the time they were written (in UTC) and the start
+// of their head, and keep the extension of the file so that they open in
+// the right program. If the same content is written twice within a second
+// (e.g. by an editor undoing a save) the later version gets a counter:
+//
+//	.amfs/history/src/main.go/20230601T150405Z-3f2a9c1b7e04-2.go
+//
+// The versions of each file are recorded in the "versions" map of the tree
+// when a file is written over NFS (see AMFileHandle.Close) or a mergeable
+// doc is synced (see receiveSync). Versions older than cfg.HistoryRetention
+// are dropped as new ones are recorded.
+const historyDir = ".amfs/history"
+
+// mergeableVersionInterval limits how many versions are kept of a mergeable
+// doc that is being edited, as editors sync every few keystrokes. Changes
+// within the same interval replace the previous version.
+const mergeableVersionInterval = time.Minute
+
+// AMVersion is a past version of a file.
+type AMVersion struct {
+	ModTime time.Time `json:"modtime"`
+	Size    int64     `json:"size"`
+	// Type is Blob if Heads[0] is the sha256 of the content, or Mergeable if
+	// Heads are the heads of the file's doc.
+	Type  AMType   `json:"type"`
+	Heads [][]byte `json:"heads"`
+}
+
+// recordVersion adds v to the versions of the file in tx, dropping any that
+// are older than cfg.HistoryRetention (if it is set).
+// The caller must be inside fs.update.
+func (fs *AMFS) recordVersion(tx *atx, amid AMID, v *AMVersion) *atx {
+	versions, err := automerge.As[[]*AMVersion](fs.doc.Path("versions", amid).Get())
+	if err != nil {
+		// the list is recreated by Append if it is missing or invalid
+		versions = nil
+	}
+
+	if n := len(versions); n > 0 && versions[n-1] != nil && v.Type == Mergeable && versions[n-1].Type == Mergeable &&
+		v.ModTime.Truncate(mergeableVersionInterval).Equal(versions[n-1].ModTime.Truncate(mergeableVersionInterval)) {
+		tx = tx.Set("versions", amid, n-1).To(v)
+	} else {
+		tx = tx.Append("versions", amid).To(v)
+	}
+
+	if fs.cfg.HistoryRetention <= 0 {
+		return tx
+	}
+	cutoff := time.Now().Add(-fs.cfg.HistoryRetention)
+	for i := 0; i < len(versions)-1 && (versions[i] == nil || versions[i].ModTime.Before(cutoff)); i++ {
+		tx = tx.Del("versions", amid, 0)
+	}
+	return tx
+}
+
+// versionName returns the name of the version in .amfs/history, adding a
+// counter if the name is in taken (the names of the file's earlier
+// versions). The name is added to taken.
+func versionName(v *AMVersion, ext string, taken map[string]bool) string {
+	head := ""
+	if len(v.Heads) > 0 {
+		head = hex.EncodeToString(v.Heads[0])
+	}
+	if len(head) > 12 {
+		head = head[:12]
+	}
+	base := v.ModTime.UTC().Format("20060102T150405Z") + "-" + head
+	name := base + ext
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	taken[name] = true
+	return name
+}
+
+// listVersions returns the versions of the file, oldest first. The current
+// content is always included, even if it was written before versions were
+// recorded.
+// The caller must be inside fs.view.
+func (fs *AMFS) listVersions(amid AMID, name string) ([]*AMFileInfo, error) {
+	file, err := automerge.As[*AMFile](fs.doc.Path("files", amid).Get())
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, pathError("readdir", name, nfs.NFS3ErrNoEnt)
+	}
+	versions, err := automerge.As[[]*AMVersion](fs.doc.Path("versions", amid).Get())
+	if err != nil {
+		return nil, err
+	}
+
+	if n := len(versions); len(file.Heads) > 0 &&
+		(n == 0 || versions[n-1] == nil || len(versions[n-1].Heads) == 0 || !bytes.Equal(versions[n-1].Heads[0], file.Heads[0])) {
+		versions = append(versions, &AMVersion{
+			ModTime: file.ModTime,
+			Size:    file.Size,
+			Type:    file.Type,
+			Heads:   file.Heads,
+		})
+	}
+
+	ext := filepath.Ext(name)
+	taken := map[string]bool{}
+	ret := []*AMFileInfo{}
+	for _, v := range versions {
+		if v == nil || len(v.Heads) == 0 {
+			continue
+		}
+		ret = append(ret, &AMFileInfo{
+			name: versionName(v, ext, taken),
+			amid: amid,
+			file: &AMFile{
+				Permissions: file.Permissions,
+				Size:        v.Size,
+				ModTime:     v.ModTime,
+				Type:        v.Type,
+				Heads:       v.Heads,
+			},
+			prefix:  historyDir,
+			version: true,
+		})
+	}
+	return ret, nil
+}
+
+// lookupVersion finds the version of the file called name.
+// The caller must be inside fs.view.
+func (fs *AMFS) lookupVersion(amid AMID, name string) (*AMFileInfo, error) {
+	versions, err := fs.listVersions(amid, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.name == name {
+			return v, nil
+		}
+	}
+	return nil, pathError("lookup", name, nfs.NFS3ErrNoEnt)
+}
+
+// markVersions adds the content of every recorded version to live.
+func markVersions(doc *automerge.Doc, live map[string]bool) error {
+	versions, err := automerge.As[map[AMID][]*AMVersion](doc.Path("versions").Get())
+	if err != nil {
+		return err
+	}
+	for amid, vs := range versions {
+		for _, v := range vs {
+			if v == nil || len(v.Heads) == 0 {
+				continue
+			}
+			switch v.Type {
+			case Blob:
+				live[hex.EncodeToString(v.Heads[0])] = true
+			case Mergeable:
+				live[string(amid)] = true
+			}
+		}
+	}
+	return nil
+}
+
+// carryVersions adds the versions of a file that is being replaced by a
+// rename to the versions of the file replacing it, so that history is kept
+// for editors that save by renaming a new file over the old one. Only blob
+// versions are carried over, as the versions of a mergeable file are read
+// from its own doc.
+// The caller must be inside fs.update.
+func (fs *AMFS) carryVersions(tx *atx, from, to AMID) (*atx, error) {
+	old, err := automerge.As[[]*AMVersion](fs.doc.Path("versions", from).Get())
+	if err != nil {
+		return nil, err
+	}
+	file, err := automerge.As[*AMFile](fs.doc.Path("files", from).Get())
+	if err != nil {
+		return nil, err
+	}
+	if file != nil && file.Type == Blob && len(file.Heads) > 0 {
+		if n := len(old); n == 0 || old[n-1] == nil || len(old[n-1].Heads) == 0 || !bytes.Equal(old[n-1].Heads[0], file.Heads[0]) {
+			old = append(old, &AMVersion{ModTime: file.ModTime, Size: file.Size, Type: Blob, Heads: file.Heads})
+		}
+	}
+
+	carried := []any{}
+	for _, v := range old {
+		if v != nil && v.Type == Blob && len(v.Heads) > 0 {
+			carried = append(carried, v)
+		}
+	}
+	if len(carried) == 0 {
+		return tx, nil
+	}
+	versions, err := automerge.As[[]*AMVersion](fs.doc.Path("versions", to).Get())
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		carried = append(carried, v)
+	}
+	return tx.Set("versions", to).To(carried), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryRetention(t *testing.T) {
+	for _, tc := range []struct {
+		retention time.Duration
+		versions  int
+	}{
+		{0, 3},
+		{time.Hour, 3},
+		{time.Nanosecond, 2},
+	} {
+		c := testConfig(t)
+		c.HistoryRetention = tc.retention
+		fs := openTestFS(t, c)
+		for _, content := range []string{"1", "2", "3"} {
+			writeTestFile(t, fs, "a.txt", content)
+		}
+		entries, err := fs.ReadDir(historyDir + "/a.txt")
+		fs.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != tc.versions {
+			t.Errorf("with retention %v, %d versions are kept, want %d", tc.retention, len(entries), tc.versions)
+		}
+	}
+}
+
+func TestVersionNames(t *testing.T) {
+	c := testConfig(t)
+	c.HistoryRetention = 0
+	fs := openTestFS(t, c)
+	defer fs.Close()
+	for _, content := range []string{"A", "B", "A"} {
+		writeTestFile(t, fs, "a.txt", content)
+	}
+	info, err := fs.getFileInfo("a.txt", None, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if they were all written within the same second
+	err = fs.update(func() error {
+		tx := fs.Tx()
+		for i := 0; i < 3; i++ {
+			tx = tx.Set("versions", info.amid, i, "modtime").To(testMoveTime)
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := fs.ReadDir(historyDir + "/a.txt")
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("%d versions: %v", len(entries), err)
+	}
+	names := map[string]bool{}
+	contents := map[string]int{}
+	for _, e := range entries {
+		names[e.Name()] = true
+		contents[readTestFile(t, fs, historyDir+"/a.txt/"+e.Name())]++
+	}
+	if len(names) != 3 || contents["A"] != 2 || contents["B"] != 1 {
+		t.Fatalf("versions %v have %v", names, contents)
+	}
+}
@@ -1,4 +1,5 @@
 import * as net from 'net'
+import * as path from 'path'
 import * as automerge from '@automerge/automerge'
 import * as vscode from 'vscode'
 
@@ -101,7 +102,9 @@ export class Connection {
 
   async connect () {
     this.connection ||= new Promise((resolve, reject) => {
-      const client = net.createConnection('/tmp/amfs.sock')
+      // the daemon listens in its data directory, see UnixListen in cfg.go
+      const client = net.createConnection(process.env.AMFS_SOCKET ||
+        path.join(process.env.AMFS_DATA || 'amfs-data', 'amfs.sock'))
 
       client.on('connect', () => resolve(client))
       client.on('data', data => this.receive(data))